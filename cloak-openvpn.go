@@ -2,45 +2,126 @@ package main
 
 import (
 	"bufio"
-	"bytes"
 	"fmt"
 	"io"
 	"io/fs"
-	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+// ccdWorkers - number of concurrent ccd file readers.
+const ccdWorkers = 16
+
+// ccdCache - ccd file name -> mapping, valid while the file is not modified.
+type ccdCache map[string]ccdCacheEntry
+
+type ccdCacheEntry struct {
+	ModTime int64  `json:"mtime"`
+	Size    int64  `json:"size"`
+	Key     string `json:"key,omitempty"`
+	UID     string `json:"uid,omitempty"`
+	Err     string `json:"err,omitempty"`
+	// uncached - a read error, which may be transient, is not kept in the cache.
+	uncached bool
+}
+
 // getOVCPeerMaps - mapping
 // [common name] -> wg public key.
 // [cloak uid] -> wg public key.
-func getOVCPeerMaps(myFS fs.FS, path string, list []fs.DirEntry) (map[string]string, map[string]string, error) {
+// Files are read concurrently, unchanged files are taken from the cache,
+// which is updated in place if not nil. Unreadable and malformed files
+// are reported in the diagnostic.
+func getOVCPeerMaps(myFS fs.FS, path string, list []fs.DirEntry, cache ccdCache) (map[string]string, map[string]string, diagnostic, error) {
+	entries := make([]ccdCacheEntry, len(list))
+
+	jobs := make(chan int)
+	wg := sync.WaitGroup{}
+
+	for range min(ccdWorkers, len(list)) {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for i := range jobs {
+				entries[i] = readOVCMappingEntry(myFS, path, list[i], cache)
+			}
+		}()
+	}
+
+	for i := range list {
+		jobs <- i
+	}
+
+	close(jobs)
+	wg.Wait()
+
 	cnMap := make(map[string]string)
 	uidMap := make(map[string]string)
+	diag := diagnostic{}
 
-	for _, entry := range list {
-		key, uid, err := readOVCMappingFile(myFS, path, entry)
-		if err != nil {
-			// fmt.Fprintf(os.Stderr, "read openvpn ccd file: %s\n", err)
+	if cache != nil {
+		clear(cache)
+	}
 
-			continue
+	for i, entry := range list {
+		e := entries[i]
+
+		if cache != nil && !e.uncached {
+			cache[entry.Name()] = e
 		}
 
-		if key == "" || uid == "" {
+		if e.Err != "" {
+			diag.Errors = append(diag.Errors, fmt.Sprintf("ccd %s: %s", entry.Name(), e.Err))
+
 			continue
 		}
 
-		cnMap[entry.Name()] = key
-		uidMap[uid] = key
+		cnMap[entry.Name()] = e.Key
+		uidMap[e.UID] = e.Key
+	}
+
+	return cnMap, uidMap, diag, nil
+}
+
+// readOVCMappingEntry - mapping of the ccd file, from the cache
+// if the file modification time and size are not changed.
+// Read errors are not cached, an empty key or uid is.
+func readOVCMappingEntry(myFS fs.FS, path string, entry fs.DirEntry, cache ccdCache) ccdCacheEntry {
+	info, err := entry.Info()
+	if err != nil {
+		return ccdCacheEntry{Err: fmt.Sprintf("stat file: %s", err), uncached: true}
+	}
+
+	e := ccdCacheEntry{
+		ModTime: info.ModTime().UnixNano(),
+		Size:    info.Size(),
 	}
 
-	return cnMap, uidMap, nil
+	if cached, ok := cache[entry.Name()]; ok && cached.ModTime == e.ModTime && cached.Size == e.Size {
+		return cached
+	}
+
+	key, uid, err := readOVCMappingFile(myFS, path, entry)
+
+	switch {
+	case err != nil:
+		e.Err, e.uncached = err.Error(), true
+	case key == "" || uid == "":
+		e.Err = "empty key or uid"
+	default:
+		e.Key, e.UID = key, uid
+	}
+
+	return e
 }
 
 // readOVCMappingFile - read openvpn ccd file and return mapping
-// [wg public key] , uid.
+// [wg public key] , uid, both are empty if there is no mapping line.
+// Errors are read errors only.
 func readOVCMappingFile(myFS fs.FS, path string, entry fs.DirEntry) (string, string, error) {
 	f, err := myFS.Open(filepath.Join(path, entry.Name()))
 	if err != nil {
@@ -73,129 +154,227 @@ func readOVCMappingFile(myFS fs.FS, path string, entry fs.DirEntry) (string, str
 		return "", "", fmt.Errorf("scan file: %w", err)
 	}
 
-	return "", "", fmt.Errorf("no line found")
+	return "", "", nil
 }
 
-// extractOpenVPNStatus - extract openvpn status from reader,
-// ussually from "/opt/openvpn-%s/status.log".
-// Status only onlines, not offline.
-func extractOpenVPNStatus(reader io.Reader) ([]byte, error) {
-	scanner := bufio.NewScanner(reader)
+// parseOpenVPNStatus - parse openvpn status from data, return map of openvpn status
+// and map of unmapped common name -> openvpn status.
+// Sessions of the same peer (duplicate-cn, reconnect) are summed.
+func parseOpenVPNStatus(clients []openVPNStatus, peerMap map[string]string) (map[string]openVPNStatus, map[string]openVPNStatus, error) {
+	statuses := make(map[string]openVPNStatus)
+	unmapped := make(map[string]openVPNStatus)
 
-	scanner.Split(func(data []byte, atEOF bool) (advance int, token []byte, err error) {
-		header := "Common Name,Real Address,Bytes Received,Bytes Sent,Connected Since\n"
+	for _, status := range clients {
+		status.sessions = []openVPNStatus{status}
 
-		idx := bytes.Index(data, []byte(header))
-		if idx == -1 {
-			return 0, nil, fmt.Errorf("%q not found", header)
+		key, ok := peerMap[status.commonName]
+		if !ok {
+			if existing, ok := unmapped[status.commonName]; ok {
+				status = sumOpenVPNStatus(existing, status)
+			}
+
+			unmapped[status.commonName] = status
+
+			continue
 		}
 
-		start := idx + len(header)
-		footer := "ROUTING TABLE"
+		if existing, ok := statuses[key]; ok {
+			status = sumOpenVPNStatus(existing, status)
+		}
+
+		statuses[key] = status
+	}
+
+	return statuses, unmapped, nil
+}
+
+// sumOpenVPNStatus - sum bytes of two sessions of the same peer,
+// keep the earliest connected since.
+func sumOpenVPNStatus(a, b openVPNStatus) openVPNStatus {
+	sum := sumTraffic(
+		traffic{Received: a.bytesReceived, Sent: a.bytesSent},
+		traffic{Received: b.bytesReceived, Sent: b.bytesSent},
+	)
+
+	earliest := a
+	if b.connectedEarlier(a) {
+		earliest = b
+	}
+
+	earliest.bytesReceived = sum.Received
+	earliest.bytesSent = sum.Sent
+
+	if laterUnix(b.lastRef, a.lastRef) {
+		earliest.lastRef = b.lastRef
+	} else {
+		earliest.lastRef = a.lastRef
+	}
 
-		idx = bytes.Index(data[start:], []byte(footer))
-		if idx == -1 {
-			return 0, nil, fmt.Errorf("%q not found", footer)
+	earliest.sessions = append(a.sessions, b.sessions...)
+
+	return earliest
+}
+
+// openVPNStatuses - openvpn status of the one protocol.
+type openVPNStatuses struct {
+	// peers - wg public key -> openvpn status.
+	peers map[string]openVPNStatus
+	// unmapped - common name -> openvpn status.
+	unmapped map[string]openVPNStatus
+}
+
+// read "/opt/openvpn-%s/status.log" and extract openvpn status
+// read "grep -rH ^# /opt/openvpn-%s/ccd/" and extract openvpn peers
+// return protocol -> openvpn status, status update time and skipped lines count.
+func getOpenVPNStatus(statusR io.Reader, cnMap map[string]string) (map[string]openVPNStatuses, time.Time, int, error) {
+	status, updated, skipped, err := extractOpenVPNStatus(statusR)
+	if err != nil {
+		return nil, time.Time{}, 0, fmt.Errorf("extract openvpn status: %w", err)
+	}
+
+	byProto := make(map[string][]openVPNStatus)
+	for _, s := range status {
+		protoName := openVPNProto(s.realAddress)
+		byProto[protoName] = append(byProto[protoName], s)
+	}
+
+	statuses := make(map[string]openVPNStatuses, len(byProto))
+	for protoName, list := range byProto {
+		statusMap, unmapped, err := parseOpenVPNStatus(list, cnMap)
+		if err != nil {
+			return nil, time.Time{}, 0, fmt.Errorf("parse openvpn status: %w", err)
 		}
 
-		end := start + idx
+		statuses[protoName] = openVPNStatuses{peers: statusMap, unmapped: unmapped}
+	}
 
-		return len(data), data[start:end], nil
-	})
+	return statuses, updated, skipped, nil
+}
 
-	if !scanner.Scan() {
-		return nil, scanner.Err()
+// openVPNProto - clients come through cloak on loopback,
+// any other real address is a plain openvpn client.
+func openVPNProto(realAddress string) string {
+	ip, err := parseOpenVPNRealAddress(realAddress)
+	if err != nil || ip.IsLoopback() {
+		return protoOpenVPNOverCloak
 	}
 
-	return scanner.Bytes(), nil
+	return protoOpenVPN
 }
 
-type openVPNStatus struct {
-	commonName     string
-	realAddress    string
-	bytesReceived  string
-	bytesSent      string
-	connectedSince string
+// assembleOpenVPNTraffic - assemble openvpn traffic from openvpn status,
+// all of it is the instance transport, if known.
+func assembleOpenVPNTraffic(status map[string]openVPNStatus, protoName string, transport string) peer[traffic] {
+	peers := make(peer[traffic])
+
+	for k, s := range status {
+		peers[k] = map[string]traffic{protoName: openVPNTraffic(s, transport)}
+	}
+
+	return peers
 }
 
-// parseOpenVPNStatus - parse openvpn status from data, return map of openvpn status.
-func parseOpenVPNStatus(data []byte, peerMap map[string]string) (map[string]openVPNStatus, error) {
-	statuses := make(map[string]openVPNStatus)
-	scanner := bufio.NewScanner(bytes.NewReader(data))
+// openVPNTraffic - traffic of the summed status with the transport breakdown.
+func openVPNTraffic(s openVPNStatus, transport string) traffic {
+	t := traffic{
+		Received: s.bytesReceived,
+		Sent:     s.bytesSent,
+	}
 
-	for scanner.Scan() {
-		line := scanner.Text()
+	if transport != "" {
+		t.addTransport(transport, parseCounter(s.bytesReceived), parseCounter(s.bytesSent))
+	}
 
-		fields := strings.Split(line, ",")
-		if len(fields) != 5 {
-			fmt.Fprintf(os.Stderr, "invalid line: %q\n", line)
+	return t
+}
 
-			continue
+// assembleOpenVPNSessions - assemble openvpn session count from openvpn status,
+// individual sessions are listed if list is set.
+func assembleOpenVPNSessions(status map[string]openVPNStatus, protoName string, list bool) peer[sessions] {
+	peers := make(peer[sessions])
+
+	for k, s := range status {
+		ss := sessions{
+			Count:          strconv.Itoa(len(s.sessions)),
+			ConnectedSince: s.connectedSinceUnix,
 		}
 
-		statuses[peerMap[fields[0]]] = openVPNStatus{
-			commonName:     fields[0],
-			realAddress:    fields[1],
-			bytesReceived:  fields[2],
-			bytesSent:      fields[3],
-			connectedSince: fields[4],
+		if list {
+			for _, x := range s.sessions {
+				ss.List = append(ss.List, x.session())
+			}
 		}
+
+		peers[k] = map[string]sessions{protoName: ss}
 	}
 
-	return statuses, nil
+	return peers
 }
 
-// read "/opt/openvpn-%s/status.log" and extract openvpn status
-// read "grep -rH ^# /opt/openvpn-%s/ccd/" and extract openvpn peers
-func getOpenVPNStatus(statusR io.Reader, cnMap map[string]string) (map[string]openVPNStatus, error) {
-	status, err := extractOpenVPNStatus(statusR)
-	if err != nil {
-		return nil, fmt.Errorf("extract openvpn status: %w", err)
-	}
+// assembleOpenVPNUnattributed - assemble openvpn traffic of unmapped common names.
+func assembleOpenVPNUnattributed(unmapped map[string]openVPNStatus, protoName string, transport string) unattributed {
+	un := make(unattributed)
 
-	statusMap, err := parseOpenVPNStatus(status, cnMap)
-	if err != nil {
-		return nil, fmt.Errorf("parse openvpn status: %w", err)
+	for cn, s := range unmapped {
+		un.add(protoName, cn, openVPNTraffic(s, transport))
 	}
 
-	return statusMap, nil
+	return un
 }
 
-// assembleOpenVPNTraffic - assemble openvpn traffic from openvpn status.
-func assembleOpenVPNTraffic(status map[string]openVPNStatus) peer[traffic] {
-	peers := make(peer[traffic])
+// assembleOpenVPNLastSeen - assemble openvpn last seen from openvpn status,
+// the routing table last ref, or the session start if there is no route.
+func assembleOpenVPNLastSeen(status map[string]openVPNStatus, protoName string) peer[lastSeen] {
+	peers := make(peer[lastSeen])
 
 	for k, s := range status {
-		peers[k] = map[string]traffic{
-			protoOpenVPNOverCloak: {
-				Received: s.bytesReceived,
-				Sent:     s.bytesSent,
-			},
+		ts := s.lastRef
+		if ts == "" {
+			ts = s.connectedSinceUnix
+		}
+
+		if ts == "" {
+			continue
 		}
+
+		peers[k] = map[string]lastSeen{protoName: {Timestamp: ts}}
 	}
 
 	return peers
 }
 
-// assembleOpenVPNLastSeen - assemble openvpn last seen from openvpn status.
-func assembleOpenVPNLastSeen(status map[string]openVPNStatus) peer[lastSeen] {
-	peers := make(peer[lastSeen])
-	ts := strconv.FormatInt(time.Now().Unix(), 10)
+// assembleOpenVPNEndpoints - assemble plain openvpn endpoints from the real address.
+func assembleOpenVPNEndpoints(status map[string]openVPNStatus) peer[endpoints] {
+	peers := make(peer[endpoints])
+
+	for k, s := range status {
+		ip, err := parseOpenVPNRealAddress(s.realAddress)
+		if err != nil {
+			debugLog("openvpn real address:", err)
+
+			continue
+		}
+
+		subnet, err := ipToSubnet(ip.String())
+		if err != nil {
+			debugLog("get subnet from ip:", err)
+
+			continue
+		}
 
-	for k := range status {
-		peers[k] = map[string]lastSeen{protoOpenVPNOverCloak: {Timestamp: ts}}
+		peers[k] = map[string]endpoints{protoOpenVPN: {Subnet: subnet}}
 	}
 
 	return peers
 }
 
-func assembleOVCEndpoints(cloakEndpoints map[string]string, uidMap map[string]string, status map[string]openVPNStatus) peer[endpoints] {
+func assembleOVCEndpoints(cloakEndpoints map[string]cloakEndpoint, uidMap map[string]string, status map[string]openVPNStatus) peer[endpoints] {
 	peers := make(peer[endpoints])
 
 	for uid, key := range uidMap {
-		if subnet, ok := cloakEndpoints[uid]; ok {
+		if e, ok := cloakEndpoints[uid]; ok {
 			if _, ok := status[key]; ok {
-				peers[key] = map[string]endpoints{protoOpenVPNOverCloak: {Subnet: subnet}}
+				peers[key] = map[string]endpoints{protoOpenVPNOverCloak: {Subnet: e.subnet, Recent: e.subnets()}}
 			}
 		}
 	}
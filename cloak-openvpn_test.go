@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io/fs"
 	"testing"
+	"testing/fstest"
 )
 
 //go:embed test_data
@@ -24,7 +25,7 @@ func TestOpenvpnTraffic(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	cnMap, _, err := getOVCPeerMaps(rootFS, fmt.Sprintf("opt/openvpn-%s/ccd", ovcTestWgi), peersReader)
+	cnMap, _, _, err := getOVCPeerMaps(rootFS, fmt.Sprintf("opt/openvpn-%s/ccd", ovcTestWgi), peersReader, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -36,11 +37,31 @@ func TestOpenvpnTraffic(t *testing.T) {
 
 	defer statusFile.Close()
 
-	status, err := getOpenVPNStatus(statusFile, cnMap)
+	statuses, _, _, err := getOpenVPNStatus(statusFile, cnMap)
 	if err != nil {
 		t.Fatal(err)
 	}
-	peers := assembleOpenVPNTraffic(status)
+
+	status, unmapped := statuses[protoOpenVPNOverCloak].peers, statuses[protoOpenVPNOverCloak].unmapped
+	peers := assembleOpenVPNTraffic(status, protoOpenVPNOverCloak, "")
+
+	if tr := peers["nmOqrxuL+jZPtcmDN5T2uOioAfgCVTgCxiD32k2YWag="][protoOpenVPNOverCloak]; tr.Received != "20630" || tr.Sent != "26832" {
+		t.Errorf("duplicate sessions are not summed: %+v", tr)
+	}
+
+	ss := assembleOpenVPNSessions(status, protoOpenVPNOverCloak, true)
+	if s := ss["nmOqrxuL+jZPtcmDN5T2uOioAfgCVTgCxiD32k2YWag="][protoOpenVPNOverCloak]; s.Count != "2" || len(s.List) != 2 {
+		t.Errorf("unexpected sessions: %+v", s)
+	}
+
+	if s := status["nmOqrxuL+jZPtcmDN5T2uOioAfgCVTgCxiD32k2YWag="]; s.connectedSince != "2024-07-20 22:00:00" {
+		t.Errorf("expected earliest connected since, got %q", s.connectedSince)
+	}
+
+	un := assembleOpenVPNUnattributed(unmapped, protoOpenVPNOverCloak, "")
+	if tr := un[protoOpenVPNOverCloak]["fcea9ff1-93ae-494b-b655-ef762cbfeecf"]; tr.Received != "1000" || tr.Sent != "2000" {
+		t.Errorf("unexpected unattributed traffic: %+v", tr)
+	}
 
 	res, err := json.MarshalIndent(peers, "", "  ")
 	if err != nil {
@@ -61,7 +82,7 @@ func TestOpenvpnLastSeen(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	cnMap, _, err := getOVCPeerMaps(rootFS, fmt.Sprintf("opt/openvpn-%s/ccd", ovcTestWgi), peersReader)
+	cnMap, _, _, err := getOVCPeerMaps(rootFS, fmt.Sprintf("opt/openvpn-%s/ccd", ovcTestWgi), peersReader, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -73,12 +94,12 @@ func TestOpenvpnLastSeen(t *testing.T) {
 
 	defer statusFile.Close()
 
-	status, err := getOpenVPNStatus(statusFile, cnMap)
+	statuses, _, _, err := getOpenVPNStatus(statusFile, cnMap)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	peers := assembleOpenVPNLastSeen(status)
+	peers := assembleOpenVPNLastSeen(statuses[protoOpenVPNOverCloak].peers, protoOpenVPNOverCloak)
 
 	res, err := json.MarshalIndent(peers, "", "  ")
 	if err != nil {
@@ -99,7 +120,7 @@ func TestOpenvpnEndpoints(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	cnMap, uidMap, err := getOVCPeerMaps(rootFS, fmt.Sprintf("opt/openvpn-%s/ccd", ovcTestWgi), peersReader)
+	cnMap, uidMap, _, err := getOVCPeerMaps(rootFS, fmt.Sprintf("opt/openvpn-%s/ccd", ovcTestWgi), peersReader, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -111,12 +132,12 @@ func TestOpenvpnEndpoints(t *testing.T) {
 
 	defer statusFile.Close()
 
-	status, err := getOpenVPNStatus(statusFile, cnMap)
+	statuses, _, _, err := getOpenVPNStatus(statusFile, cnMap)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	cloakEndpoints, err := getCloakEndpointsMap(&appOptions{
+	cloakEndpoints, _, err := getCloakEndpointsMap(&appOptions{
 		rootFS: rootFS,
 		wgi:    ovcTestWgi,
 	})
@@ -124,7 +145,7 @@ func TestOpenvpnEndpoints(t *testing.T) {
 		debugLog("cloak endpoints:", err)
 	}
 
-	ep := assembleOVCEndpoints(cloakEndpoints, uidMap, status)
+	ep := assembleOVCEndpoints(cloakEndpoints, uidMap, statuses[protoOpenVPNOverCloak].peers)
 
 	res, err := json.MarshalIndent(ep, "", "  ")
 	if err != nil {
@@ -133,3 +154,184 @@ func TestOpenvpnEndpoints(t *testing.T) {
 
 	t.Log(string(res))
 }
+
+func TestPlainOpenvpn(t *testing.T) {
+	rootFS, err := fs.Sub(ovcTestDataFS, "test_data")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peersReader, err := fs.ReadDir(rootFS, fmt.Sprintf("opt/openvpn-%s/ccd", ovcTestWgi))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cnMap, _, _, err := getOVCPeerMaps(rootFS, fmt.Sprintf("opt/openvpn-%s/ccd", ovcTestWgi), peersReader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	statusFile, err := rootFS.Open("outputs/openvpn-status-plain.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer statusFile.Close()
+
+	statuses, _, _, err := getOpenVPNStatus(statusFile, cnMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(statuses[protoOpenVPNOverCloak].peers); n != 1 {
+		t.Errorf("expected 1 cloak-openvpn peer, got %d", n)
+	}
+
+	ep := assembleOpenVPNEndpoints(statuses[protoOpenVPN].peers)
+
+	testCases := []struct {
+		key, subnet string
+	}{
+		{"nmOqrxuL+jZPtcmDN5T2uOioAfgCVTgCxiD32k2YWag=", "2001:db8:1::/56"},
+		{"e45JqFuA4yC78J9owAozUW9FVzxOWVxTNjU4fNp2auU=", "203.0.113.0/24"},
+	}
+
+	for _, tc := range testCases {
+		if subnet := ep[tc.key][protoOpenVPN].Subnet; subnet != tc.subnet {
+			t.Errorf("%s: expected %q, got %q", tc.key, tc.subnet, subnet)
+		}
+	}
+
+	tr := assembleOpenVPNTraffic(statuses[protoOpenVPN].peers, protoOpenVPN, transportUDP)
+
+	if x := tr["e45JqFuA4yC78J9owAozUW9FVzxOWVxTNjU4fNp2auU="][protoOpenVPN].Transport[transportUDP]; x.Received != "33333" || x.Sent != "26632" {
+		t.Errorf("unexpected udp traffic: %+v", x)
+	}
+
+	if x := assembleOpenVPNTraffic(statuses[protoOpenVPN].peers, protoOpenVPN, ""); x["e45JqFuA4yC78J9owAozUW9FVzxOWVxTNjU4fNp2auU="][protoOpenVPN].Transport != nil {
+		t.Errorf("unexpected transport of unknown instance transport: %+v", x)
+	}
+
+	res, err := json.MarshalIndent(ep, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Log(string(res))
+}
+
+func TestOpenvpnPeerMapsCache(t *testing.T) {
+	rootFS, err := fs.Sub(ovcTestDataFS, "test_data")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := fmt.Sprintf("opt/openvpn-%s/ccd", ovcTestWgi)
+
+	peersReader, err := fs.ReadDir(rootFS, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache := make(ccdCache)
+
+	cnMap, _, diag, err := getOVCPeerMaps(rootFS, path, peersReader, cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cnMap) != 2 || len(cache) != 3 {
+		t.Fatalf("expected 2 mappings and 3 cache entries, got %d and %d", len(cnMap), len(cache))
+	}
+
+	// empty ccd file.
+	if len(diag.Errors) != 1 {
+		t.Errorf("expected 1 error, got %v", diag.Errors)
+	}
+
+	// unchanged file is taken from the cache.
+	e := cache["5bdb0d91-9195-4fcf-a264-c1feb1a3b0fe"]
+	e.Key = "cached"
+	cache["5bdb0d91-9195-4fcf-a264-c1feb1a3b0fe"] = e
+
+	cnMap, _, _, err = getOVCPeerMaps(rootFS, path, peersReader, cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if key := cnMap["5bdb0d91-9195-4fcf-a264-c1feb1a3b0fe"]; key != "cached" {
+		t.Errorf("expected cached key, got %q", key)
+	}
+}
+
+func TestOpenVPNInstanceStale(t *testing.T) {
+	rootFS, err := fs.Sub(ovcTestDataFS, "test_data")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o := &appOptions{
+		rootFS: rootFS,
+		wgi:    ovcTestWgi,
+		stats: &stat{Data: data{
+			Traffic:      make(peer[traffic]),
+			LastSeen:     make(peer[lastSeen]),
+			Endpoints:    make(peer[endpoints]),
+			Sessions:     make(peer[sessions]),
+			Diagnostics:  make(diagnostics),
+			Unattributed: make(unattributed),
+		}},
+	}
+
+	// the fixture status was updated long ago.
+	if err := handleOpenVPNInstance(o, fmt.Sprintf("opt/openvpn-%s", ovcTestWgi), "", protoOpenVPNOverCloak, nil, make(map[string]string)); err != nil {
+		t.Fatal(err)
+	}
+
+	if d := o.stats.Data.Diagnostics[protoOpenVPNOverCloak]; d.StaleSince == "" {
+		t.Errorf("stale status is not reported: %+v", d)
+	}
+
+	if n := len(o.stats.Data.Traffic) + len(o.stats.Data.LastSeen) + len(o.stats.Data.Endpoints) + len(o.stats.Data.Sessions) + len(o.stats.Data.Unattributed); n != 0 {
+		t.Errorf("stale status is reported as live: %d entries", n)
+	}
+}
+
+func TestOpenvpnPeerMapsCacheReadError(t *testing.T) {
+	myFS := fstest.MapFS{
+		"ccd/mapped":     {Data: []byte("#key uid\n")},
+		"ccd/gone":       {Data: []byte("#key2 uid2\n")},
+		"ccd/no-mapping": {Data: []byte("push \"route 10.0.0.0 255.0.0.0\"\n")},
+	}
+
+	list, err := fs.ReadDir(myFS, "ccd")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the file disappears between the listing and the read.
+	delete(myFS, "ccd/gone")
+
+	cache := make(ccdCache)
+
+	_, _, diag, err := getOVCPeerMaps(myFS, "ccd", list, cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(diag.Errors) != 2 {
+		t.Errorf("expected 2 errors, got %v", diag.Errors)
+	}
+
+	if e := cache["mapped"]; e.Key != "key" || e.UID != "uid" {
+		t.Errorf("unexpected mapping: %+v", e)
+	}
+
+	if _, ok := cache["gone"]; ok {
+		t.Errorf("read error is cached")
+	}
+
+	if e, ok := cache["no-mapping"]; !ok || e.Err == "" {
+		t.Errorf("empty mapping is not cached: %+v", e)
+	}
+}
@@ -2,56 +2,211 @@ package main
 
 import (
 	"bufio"
+	"encoding/base64"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"io/fs"
+	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
 )
 
-func getCloakEndpointsMap(o *appOptions) (map[string]string, error) {
-	authDbFile, err := o.rootFS.Open(fmt.Sprintf("opt/cloak-%s/userinfo/userauthdb.log", o.wgi))
+// cloakRecentEndpoints - max number of recent distinct endpoint subnets per uid.
+const cloakRecentEndpoints = 5
+
+// cloakEndpoint - cloak uid endpoint from the authdb.
+type cloakEndpoint struct {
+	// subnet - the newest endpoint subnet.
+	subnet string
+	// lastSeen - unix time of the newest login, empty for the legacy format.
+	lastSeen string
+	// recent - recent distinct endpoint subnets, the newest first.
+	recent []cloakRecentEndpoint
+}
+
+type cloakRecentEndpoint struct {
+	subnet string
+	ts     int64
+}
+
+// add - add login, the newest login wins. Legacy logins have no time,
+// the last line wins for them.
+func (e *cloakEndpoint) add(subnet string, ts int64) {
+	// the same subnet is moved to the newer position.
+	for i, r := range e.recent {
+		if r.subnet == subnet {
+			if ts != 0 && ts < r.ts {
+				return
+			}
+
+			e.recent = slices.Delete(e.recent, i, i+1)
+
+			break
+		}
+	}
+
+	idx := 0
+	if ts != 0 {
+		idx = slices.IndexFunc(e.recent, func(r cloakRecentEndpoint) bool { return r.ts < ts })
+		if idx == -1 {
+			idx = len(e.recent)
+		}
+	}
+
+	e.recent = slices.Insert(e.recent, idx, cloakRecentEndpoint{subnet: subnet, ts: ts})
+	if len(e.recent) > cloakRecentEndpoints {
+		e.recent = e.recent[:cloakRecentEndpoints]
+	}
+
+	e.subnet = e.recent[0].subnet
+	e.lastSeen = ""
+
+	if e.recent[0].ts != 0 {
+		e.lastSeen = strconv.FormatInt(e.recent[0].ts, 10)
+	}
+}
+
+// subnets - recent subnets, the newest first.
+func (e cloakEndpoint) subnets() []string {
+	list := make([]string, 0, len(e.recent))
+	for _, r := range e.recent {
+		list = append(list, r.subnet)
+	}
+
+	return list
+}
+
+// getCloakEndpointsMap - cloak endpoints from the authdb, rotated authdb copies
+// are read before it if authdbMaxAge is set. Unreadable copies are diagnosed.
+func getCloakEndpointsMap(o *appOptions) (map[string]cloakEndpoint, diagnostic, error) {
+	path := fmt.Sprintf("opt/cloak-%s/userinfo/userauthdb.log", o.wgi)
+
+	var (
+		diag    diagnostic
+		readers []io.Reader
+	)
+
+	if o.authdbMaxAge > 0 {
+		list, err := rotatedSiblings(o.rootFS, path, o.authdbMaxAge, time.Now())
+		if err != nil {
+			return nil, diagnostic{}, fmt.Errorf("cloak authdb rotated: %w", err)
+		}
+
+		for _, r := range list {
+			rc, err := openLog(o.rootFS, r.path)
+			if err != nil {
+				debugLog("cloak authdb:", err)
+				diag.Errors = append(diag.Errors, r.path)
+
+				continue
+			}
+
+			defer rc.Close()
+
+			// the last line may have no newline.
+			readers = append(readers, rc, strings.NewReader("\n"))
+		}
+	}
+
+	authDbFile, err := o.rootFS.Open(path)
 	if err != nil {
-		return nil, fmt.Errorf("openvpn authdb file: %w", err)
+		return nil, diagnostic{}, fmt.Errorf("cloak authdb file: %w", err)
 	}
 
 	defer authDbFile.Close()
 
-	return parseCloakEndpoints(authDbFile)
+	endpoints, parseDiag, err := parseCloakEndpoints(io.MultiReader(append(readers, authDbFile)...))
+
+	diag.Skipped += parseDiag.Skipped
+
+	return endpoints, diag, err
 }
 
-// parseCloakEndpoints - mapping cloak uid -> ip subnet.
+// parseCloakEndpoints - mapping cloak uid -> endpoint.
 // ussuallly from /opt/cloak-{wgi}/userinfo/userauthdb.log
-func parseCloakEndpoints(authDb io.Reader) (map[string]string, error) {
-	m := make(map[string]string)
+// Line formats:
+//
+//	uid ip
+//	uid ip unixtime
+//	uid isotime ip unixtime
+//
+// Malformed lines are skipped and counted, empty ones are ignored.
+func parseCloakEndpoints(authDb io.Reader) (map[string]cloakEndpoint, diagnostic, error) {
+	endpoints := make(map[string]cloakEndpoint)
+	diag := diagnostic{}
 
 	scanner := bufio.NewScanner(authDb)
 	for scanner.Scan() {
 		line := scanner.Text()
 
+		var (
+			uid, ip, unix string
+			ts            int64
+		)
+
 		fields := strings.Fields(line)
-		if len(fields) != 2 {
-			return nil, fmt.Errorf("invalid line: %q", line)
+		switch len(fields) {
+		case 0:
+			continue
+		case 2:
+			uid, ip = fields[0], fields[1]
+		case 3:
+			uid, ip, unix = fields[0], fields[1], fields[2]
+		case 4:
+			uid, ip, unix = fields[0], fields[2], fields[3]
+		default:
+			debugLog("cloak authdb: invalid line:", line)
+			diag.Skipped++
+
+			continue
 		}
 
-		// uid -> ip
-		m[fields[0]] = fields[1]
-	}
+		if unix != "" {
+			var err error
+			if ts, err = strconv.ParseInt(unix, 10, 64); err != nil || ts <= 0 {
+				debugLog("cloak authdb: invalid timestamp:", line)
+				diag.Skipped++
 
-	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("scan authdb: %w", err)
-	}
+				continue
+			}
+		}
 
-	endpoints := make(map[string]string)
-	for uid, ip := range m {
 		subnet, err := ipToSubnet(ip)
 		if err != nil {
-			return nil, fmt.Errorf("get subnet from ip: %w: %s", err, ip)
+			debugLog("cloak authdb: get subnet from ip:", err)
+			diag.Skipped++
+
+			continue
 		}
 
-		endpoints[uid] = subnet
+		e := endpoints[uid]
+		e.add(subnet, ts)
+		endpoints[uid] = e
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, diag, fmt.Errorf("scan authdb: %w", err)
 	}
 
-	return endpoints, nil
+	return endpoints, diag, nil
+}
+
+// assembleCloakLastSeen - assemble cloak last seen from the authdb logins.
+func assembleCloakLastSeen(cloakEndpoints map[string]cloakEndpoint, uidMap map[string]string) peer[lastSeen] {
+	peers := make(peer[lastSeen])
+
+	for uid, key := range uidMap {
+		if e, ok := cloakEndpoints[uid]; ok && e.lastSeen != "" {
+			peers[key] = map[string]lastSeen{protoCloak: {Timestamp: e.lastSeen}}
+		}
+	}
+
+	return peers
 }
 
 // getCloakPeerMaps - mapping
@@ -92,3 +247,176 @@ func getCloakPeerMaps(myFS fs.FS, userlist string) (map[string]string, error) {
 
 	return uidMap, nil
 }
+
+// cloakCredit - cloak user rates (bytes/s) and remaining credit (bytes)
+// from the cloak user database.
+type cloakCredit struct {
+	upRate     int64
+	downRate   int64
+	upCredit   int64
+	downCredit int64
+}
+
+// readCloakUserDB - read cloak user database read-only,
+// ussually opt/cloak-{wgi}/userinfo/userinfo.db.
+// The running ck-server holds an exclusive lock on the database,
+// so a copy of it is read.
+// Every user is a bucket named by raw uid, values are big endian int64.
+// Return mapping cloak uid (base64) -> credit.
+func readCloakUserDB(myFS fs.FS, path string) (map[string]cloakCredit, error) {
+	snapshot, err := copyCloakUserDB(myFS, path)
+	if err != nil {
+		return nil, fmt.Errorf("copy db: %w", err)
+	}
+
+	defer os.Remove(snapshot)
+
+	db, err := bolt.Open(snapshot, 0o400, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open db: %w", err)
+	}
+
+	defer db.Close()
+
+	credits := make(map[string]cloakCredit)
+
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			credits[base64.StdEncoding.EncodeToString(name)] = cloakCredit{
+				upRate:     cloakInt64(b.Get([]byte("UpRate"))),
+				downRate:   cloakInt64(b.Get([]byte("DownRate"))),
+				upCredit:   cloakInt64(b.Get([]byte("UpCredit"))),
+				downCredit: cloakInt64(b.Get([]byte("DownCredit"))),
+			}
+
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("read db: %w", err)
+	}
+
+	return credits, nil
+}
+
+// copyCloakUserDB - copy the database to a temporary file, return its path.
+func copyCloakUserDB(myFS fs.FS, path string) (string, error) {
+	src, err := myFS.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("open: %w", err)
+	}
+
+	defer src.Close()
+
+	dst, err := os.CreateTemp("", "cloak-userinfo-*.db")
+	if err != nil {
+		return "", fmt.Errorf("create temp: %w", err)
+	}
+
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		os.Remove(dst.Name())
+
+		return "", fmt.Errorf("copy: %w", err)
+	}
+
+	if err := dst.Close(); err != nil {
+		os.Remove(dst.Name())
+
+		return "", fmt.Errorf("close temp: %w", err)
+	}
+
+	return dst.Name(), nil
+}
+
+func cloakInt64(b []byte) int64 {
+	if len(b) != 8 {
+		return 0
+	}
+
+	return int64(binary.BigEndian.Uint64(b))
+}
+
+// cloakUsage - consumed cloak traffic, kept between runs.
+// Cloak stores only the remaining credit, so the usage is
+// a sum of the credit decreases.
+type cloakUsage struct {
+	UpCredit   int64  `json:"up-credit"`
+	DownCredit int64  `json:"down-credit"`
+	Up         uint64 `json:"up"`
+	Down       uint64 `json:"down"`
+}
+
+// cloakUsageState - cloak uid -> usage.
+type cloakUsageState map[string]cloakUsage
+
+// updateCloakUsage - account credit decrease since the previous run as usage,
+// a credit increase is a top-up and only moves the baseline.
+// Removed users are dropped from the state.
+func updateCloakUsage(state cloakUsageState, credits map[string]cloakCredit) {
+	for uid := range state {
+		if _, ok := credits[uid]; !ok {
+			delete(state, uid)
+		}
+	}
+
+	for uid, c := range credits {
+		u, ok := state[uid]
+		if ok {
+			if c.upCredit < u.UpCredit {
+				u.Up += uint64(u.UpCredit - c.upCredit)
+			}
+
+			if c.downCredit < u.DownCredit {
+				u.Down += uint64(u.DownCredit - c.downCredit)
+			}
+		}
+
+		u.UpCredit, u.DownCredit = c.upCredit, c.downCredit
+		state[uid] = u
+	}
+}
+
+// assembleCloakTraffic - assemble cloak traffic from the usage state,
+// upload of the client is received by the server. It is the fronted
+// traffic of cloak-openvpn and cloak-ss, not a traffic of its own.
+func assembleCloakTraffic(state cloakUsageState, uidMap map[string]string) peer[traffic] {
+	peers := make(peer[traffic])
+
+	for uid, u := range state {
+		key, ok := uidMap[uid]
+		if !ok {
+			continue
+		}
+
+		peers[key] = map[string]traffic{
+			protoCloak: {
+				Received: strconv.FormatUint(u.Up, 10),
+				Sent:     strconv.FormatUint(u.Down, 10),
+			},
+		}
+	}
+
+	return peers
+}
+
+// assembleCloakLimits - assemble cloak rate limits, bytes/s -> kbit/s.
+func assembleCloakLimits(credits map[string]cloakCredit, uidMap map[string]string) peer[limits] {
+	peers := make(peer[limits])
+
+	for uid, c := range credits {
+		key, ok := uidMap[uid]
+		if !ok || (c.upRate == 0 && c.downRate == 0) {
+			continue
+		}
+
+		peers[key] = map[string]limits{
+			protoCloak: {
+				Down: strconv.FormatInt(c.downRate*8/1000, 10),
+				Up:   strconv.FormatInt(c.upRate*8/1000, 10),
+			},
+		}
+	}
+
+	return peers
+}
@@ -2,9 +2,15 @@ package main
 
 import (
 	"embed"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 	"io/fs"
+	"os"
+	"path/filepath"
 	"testing"
+
+	bolt "go.etcd.io/bbolt"
 )
 
 //go:embed test_data
@@ -18,7 +24,7 @@ func TestGetCloakEndpointsMap(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	epMap, err := getCloakEndpointsMap(&appOptions{
+	epMap, diag, err := getCloakEndpointsMap(&appOptions{
 		rootFS: rootFS,
 		wgi:    cloakTestWgi,
 	})
@@ -26,10 +32,195 @@ func TestGetCloakEndpointsMap(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	res, err := json.MarshalIndent(epMap, "", "  ")
+	if diag.Skipped != 1 {
+		t.Errorf("expected 1 skipped line, got %d", diag.Skipped)
+	}
+
+	if e := epMap["JwO8/shyChtW6jIxkivGUA=="]; e.subnet != "192.168.200.0/24" || e.lastSeen != "" {
+		t.Errorf("unexpected legacy endpoint: %+v", e)
+	}
+
+	e := epMap["pMyn+XeS6WEDxHqv+MNPvg=="]
+	if e.subnet != "176.59.3.0/24" || e.lastSeen != "1720203786" {
+		t.Errorf("unexpected endpoint: %+v", e)
+	}
+
+	if recent := e.subnets(); len(recent) != 2 || recent[1] != "176.59.111.0/24" {
+		t.Errorf("unexpected recent endpoints: %v", recent)
+	}
+
+	ep, err := assembleOLCEndpoints(epMap, map[string]string{"pMyn+XeS6WEDxHqv+MNPvg==": "e45JqFuA4yC78J9owAozUW9FVzxOWVxTNjU4fNp2auU="})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := json.MarshalIndent(ep, "", "  ")
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	t.Log(string(res))
 }
+
+// testCloakUserDB - create cloak user database with the single user.
+func testCloakUserDB(t *testing.T, path string, uid string, upCredit, downCredit int64) {
+	raw, err := base64.StdEncoding.DecodeString(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := bolt.Open(path, 0o600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	i64 := func(v int64) []byte {
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, uint64(v))
+
+		return b
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(raw)
+		if err != nil {
+			return err
+		}
+
+		for k, v := range map[string]int64{
+			"UpRate":     125000,
+			"DownRate":   250000,
+			"UpCredit":   upCredit,
+			"DownCredit": downCredit,
+		} {
+			if err := b.Put([]byte(k), i64(v)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCloakUsage(t *testing.T) {
+	const (
+		uid = "JwO8/shyChtW6jIxkivGUA=="
+		key = "nmOqrxuL+jZPtcmDN5T2uOioAfgCVTgCxiD32k2YWag="
+	)
+
+	uidMap := map[string]string{uid: key}
+	state := make(cloakUsageState)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "userinfo.db")
+
+	// credit is decreased by usage, then topped up and decreased again.
+	for _, credit := range [][2]int64{{1000, 5000}, {900, 4000}, {10000, 10000}, {9990, 9900}} {
+		testCloakUserDB(t, path, uid, credit[0], credit[1])
+
+		credits, err := readCloakUserDB(os.DirFS(dir), "userinfo.db")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		updateCloakUsage(state, credits)
+	}
+
+	tr := assembleCloakTraffic(state, uidMap)[key][protoCloak]
+	if tr.Received != "110" || tr.Sent != "1100" {
+		t.Errorf("unexpected traffic: %+v", tr)
+	}
+
+	credits, err := readCloakUserDB(os.DirFS(dir), "userinfo.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := assembleCloakLimits(credits, uidMap)[key][protoCloak]
+	if l.Up != "1000" || l.Down != "2000" {
+		t.Errorf("unexpected limits: %+v", l)
+	}
+}
+
+func TestCloakUserDBLocked(t *testing.T) {
+	const uid = "JwO8/shyChtW6jIxkivGUA=="
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "userinfo.db")
+
+	testCloakUserDB(t, path, uid, 1000, 5000)
+
+	// ck-server keeps the database open read-write.
+	db, err := bolt.Open(path, 0o600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	credits, err := readCloakUserDB(os.DirFS(dir), "userinfo.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c := credits[uid]; c.upCredit != 1000 || c.downCredit != 5000 {
+		t.Errorf("unexpected credit: %+v", c)
+	}
+}
+
+func TestHandleCloak(t *testing.T) {
+	const (
+		uid = "JwO8/shyChtW6jIxkivGUA=="
+		key = "nmOqrxuL+jZPtcmDN5T2uOioAfgCVTgCxiD32k2YWag="
+	)
+
+	root := t.TempDir()
+	dir := filepath.Join(root, "opt", "cloak-"+cloakTestWgi, "userinfo")
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "userlist"), []byte("#"+key+" "+uid+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	testCloakUserDB(t, filepath.Join(dir, "userinfo.db"), uid, 1000, 5000)
+
+	o := &appOptions{
+		rootFS:   os.DirFS(root),
+		wgi:      cloakTestWgi,
+		stateDir: t.TempDir(),
+		stats: &stat{Data: data{
+			Traffic:  make(peer[traffic]),
+			LastSeen: make(peer[lastSeen]),
+			Limits:   make(peer[limits]),
+			Fronted:  make(peer[traffic]),
+		}},
+	}
+
+	usage, err := handleCloak(o, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := usage[uid]; !ok {
+		t.Errorf("usage is not kept: %+v", usage)
+	}
+
+	if l := o.stats.Data.Limits[key][protoCloak]; l.Up != "1000" || l.Down != "2000" {
+		t.Errorf("unexpected limits: %+v", l)
+	}
+
+	if _, ok := o.stats.Data.Fronted[key][protoCloak]; !ok {
+		t.Error("cloak traffic is not reported as fronted")
+	}
+
+	if _, ok := o.stats.Data.Traffic[key][protoCloak]; ok {
+		t.Error("cloak traffic is reported as a traffic of its own")
+	}
+}
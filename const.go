@@ -3,8 +3,33 @@ package main
 const (
 	protoWireguard        = "wireguard"
 	protoIPsec            = "ipsec"
+	protoL2TP             = "l2tp"
+	protoSSTP             = "sstp"
+	protoPPTP             = "pptp"
+	protoPPPoE            = "pppoe"
+	protoIKEv2            = "ikev2"
 	protoOpenVPNOverCloak = "cloak-openvpn"
+	protoOpenVPN          = "openvpn"
 	protoOutline          = "outline-ss"
 	protoOutlineOverCloak = "cloak-ss"
 	protoProto0           = "proto0"
+	protoCloak            = "cloak"
 )
+
+// knownProtos - protocol names of the collectors,
+// they can't be used as additional instance labels.
+var knownProtos = []string{
+	protoWireguard, protoIPsec, protoL2TP, protoSSTP, protoPPTP, protoPPPoE, protoIKEv2,
+	protoOpenVPNOverCloak, protoOpenVPN, protoOutline, protoOutlineOverCloak, protoProto0, protoCloak,
+}
+
+const (
+	transportTCP = "tcp"
+	transportUDP = "udp"
+)
+
+// unattributedUnknown - unattributed session id, when the original one is empty.
+const unattributedUnknown = "unknown"
+
+// geoUnknown - location or asn, when it is not reported.
+const geoUnknown = "unknown"
@@ -4,7 +4,7 @@ set -e
 
 export CGO_ENABLED=0
 
-go build -C endpoint-vpn-usage-stats -o ../bin/stats
+go build -C endpoint-vpn-usage-stats -ldflags "-X main.version=${PACKAGE_VERSION}" -o ../bin/stats
 
 go install github.com/goreleaser/nfpm/v2/cmd/nfpm@latest
 
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"os"
+	buildinfo "runtime/debug"
+)
+
+// version - set at build time with -ldflags "-X main.version=...".
+var version string
+
+// newEndpointInfo - endpoint metadata from the interface and its wg-quick env.
+func newEndpointInfo(wgi string, env map[string]string) endpointInfo {
+	info := endpointInfo{
+		Interface: wgi,
+		ExtDev:    env["EXT_DEV"],
+		ExtIP:     env["EXT_IP"],
+		ExtCIDR:   env["EXT_CIDR"],
+		Version:   buildVersion(),
+	}
+
+	if hostname, err := os.Hostname(); err == nil {
+		info.Hostname = hostname
+	}
+
+	return info
+}
+
+// buildVersion - the linked version, module version or vcs revision.
+func buildVersion() string {
+	if version != "" {
+		return version
+	}
+
+	bi, ok := buildinfo.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+
+	if bi.Main.Version != "" && bi.Main.Version != "(devel)" {
+		return bi.Main.Version
+	}
+
+	for _, s := range bi.Settings {
+		if s.Key == "vcs.revision" {
+			return s.Value
+		}
+	}
+
+	return ""
+}
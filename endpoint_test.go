@@ -0,0 +1,45 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"testing"
+)
+
+//go:embed test_data/etc/wg-quick-ns.env.*
+var endpointTestDataFS embed.FS
+
+const endpointTestWgi = "wg7"
+
+func TestNewEndpointInfo(t *testing.T) {
+	rootFS, err := fs.Sub(endpointTestDataFS, "test_data")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env, err := getWgQuickEnv(rootFS, endpointTestWgi)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if port := env["OUTLINE_SS_PORT"]; port != "54392" {
+		t.Errorf("expected outline port 54392, got %q", port)
+	}
+
+	version = "1.2.3"
+	defer func() { version = "" }()
+
+	info := newEndpointInfo(endpointTestWgi, env)
+
+	for _, tc := range []struct{ name, got, want string }{
+		{"interface", info.Interface, endpointTestWgi},
+		{"ext-dev", info.ExtDev, "ens17"},
+		{"ext-ip", info.ExtIP, "192.168.100.120"},
+		{"ext-cidr", info.ExtCIDR, "24"},
+		{"version", info.Version, "1.2.3"},
+	} {
+		if tc.got != tc.want {
+			t.Errorf("%s: expected %q, got %q", tc.name, tc.want, tc.got)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// parseEnvFile - parse shell like env file: KEY=value lines with optional
+// export, comments, single quoted (literal) and double quoted (with backslash
+// escapes) values. Unparsable lines are skipped.
+func parseEnvFile(r io.Reader) (map[string]string, error) {
+	env := make(map[string]string)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if rest, ok := strings.CutPrefix(line, "export"); ok && rest != "" && (rest[0] == ' ' || rest[0] == '\t') {
+			line = strings.TrimSpace(rest)
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok || !isEnvKey(key) {
+			debugLog("env: invalid line:", line)
+
+			continue
+		}
+
+		v, err := parseEnvValue(value)
+		if err != nil {
+			debugLog("env:", key, err)
+
+			continue
+		}
+
+		env[key] = v
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("scan: %w", err)
+	}
+
+	return env, nil
+}
+
+// isEnvKey - shell variable name.
+func isEnvKey(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for i, c := range s {
+		switch {
+		case c == '_', c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// parseEnvValue - unquote the value, quoted parts may be concatenated
+// as in shell, unquoted whitespace ends the value (a comment may follow).
+func parseEnvValue(s string) (string, error) {
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end == -1 {
+				return "", fmt.Errorf("unterminated single quote")
+			}
+
+			b.WriteString(s[i+1 : i+1+end])
+			i += end + 1
+
+		case '"':
+			for i++; ; i++ {
+				if i >= len(s) {
+					return "", fmt.Errorf("unterminated double quote")
+				}
+
+				if s[i] == '"' {
+					break
+				}
+
+				if s[i] == '\\' && i+1 < len(s) && strings.IndexByte("\"\\$`", s[i+1]) != -1 {
+					i++
+				}
+
+				b.WriteByte(s[i])
+			}
+
+		case '\\':
+			if i+1 < len(s) {
+				i++
+				b.WriteByte(s[i])
+			}
+
+		case ' ', '\t':
+			return b.String(), nil
+
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return b.String(), nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseEnvFile(t *testing.T) {
+	data := `# wg-quick env
+EXT_DEV=ens17
+export EXT_IP="192.168.100.120"
+  EXT_CIDR=24 # mask
+EXT_GW='192.168.100.1'
+HOSTNAME_NOTE="a \"quoted\" value"'#not a comment'
+EMPTY=
+BROKEN="unterminated
+1INVALID=x
+exporter=y
+OUTLINE_SS_PORT=54392`
+
+	env, err := parseEnvFile(strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"EXT_DEV":         "ens17",
+		"EXT_IP":          "192.168.100.120",
+		"EXT_CIDR":        "24",
+		"EXT_GW":          "192.168.100.1",
+		"HOSTNAME_NOTE":   `a "quoted" value#not a comment`,
+		"EMPTY":           "",
+		"exporter":        "y",
+		"OUTLINE_SS_PORT": "54392",
+	}
+
+	if len(env) != len(want) {
+		t.Errorf("unexpected env: %q", env)
+	}
+
+	for k, v := range want {
+		if got, ok := env[k]; !ok || got != v {
+			t.Errorf("%s: expected %q, got %q", k, v, got)
+		}
+	}
+}
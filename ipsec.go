@@ -9,21 +9,121 @@ import (
 	"time"
 )
 
-func parseIpsecSecrets(reader io.Reader) (map[string]string, error) {
+// parseIpsecSecrets - parse accel-ppp chap-secrets, return mapping
+// [username] -> wg public key and configured peer limits.
+// line: "username" * "secret" [ip_pool [down/up]] #pubkey
+// Lines that can't be parsed are skipped and counted,
+// entries without #pubkey are reported as unmapped.
+func parseIpsecSecrets(reader io.Reader) (map[string]string, peer[limits], diagnostic, error) {
 	username2peer := make(map[string]string)
+	peers := make(peer[limits])
+	diag := diagnostic{}
 	scanner := bufio.NewScanner(reader)
 	for scanner.Scan() {
 		line := scanner.Text()
-		fields := strings.Fields(line)
-		if len(fields) != 6 {
-			return nil, fmt.Errorf("invalid line: %q", line)
+		words, comment, err := tokenizeChapSecretsLine(line)
+		if err != nil {
+			debugLog("chap-secrets:", err)
+			diag.Skipped++
+			continue
+		}
+		if len(words) == 0 {
+			// blank or comment line
+			continue
+		}
+		if len(words) < 3 {
+			debugLog("chap-secrets: invalid line:", line)
+			diag.Skipped++
+			continue
+		}
+		trailer := strings.Fields(comment)
+		if len(trailer) == 0 {
+			diag.Unmapped = append(diag.Unmapped, words[0])
+			continue
+		}
+		key := trailer[0]
+		username2peer[words[0]] = key
+		var pool, rate string
+		if len(words) > 3 {
+			pool = words[3]
+		}
+		if len(words) > 4 {
+			rate = words[4]
+		}
+		if l := parseIpsecLimits(pool, rate); l != (limits{}) {
+			peers[key] = map[string]limits{protoIPsec: l}
 		}
-		username2peer[strings.Replace(fields[0], `"`, "", -1)] = strings.TrimPrefix(fields[5], "#")
 	}
 	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("scanner error: %w", err)
+		return nil, nil, diag, fmt.Errorf("scanner error: %w", err)
 	}
-	return username2peer, nil
+	return username2peer, peers, diag, nil
+}
+
+// tokenizeChapSecretsLine - split chap-secrets line to words like pppd does:
+// words are separated by whitespace, can be quoted with " or ',
+// backslash escapes the next character, # at the start of a word starts a comment.
+func tokenizeChapSecretsLine(line string) ([]string, string, error) {
+	var (
+		words   []string
+		word    strings.Builder
+		inWord  bool
+		quote   rune
+		escaped bool
+	)
+	for i, r := range line {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			inWord, escaped = true, true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+				continue
+			}
+			word.WriteRune(r)
+		case r == '"' || r == '\'':
+			inWord, quote = true, r
+		case r == '#' && !inWord:
+			return words, line[i+1:], nil
+		case r == ' ' || r == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			inWord = true
+			word.WriteRune(r)
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, "", fmt.Errorf("unterminated quote: %q", line)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, "", nil
+}
+
+// parseIpsecLimits - accel-ppp rate limit is "down/up" in kbit/s,
+// a single value limits both directions. Pool "*" means the default pool.
+func parseIpsecLimits(pool, rate string) limits {
+	l := limits{}
+	if pool != "*" {
+		l.Pool = pool
+	}
+	if rate == "" {
+		return l
+	}
+	down, up, ok := strings.Cut(rate, "/")
+	if !ok {
+		up = down
+	}
+	l.Down, l.Up = down, up
+	return l
 }
 
 func parseIpsec[T metrics](reader io.Reader, nFields int, fieldSetter func(peer[T], []string) error) (peer[T], error) {
@@ -48,56 +148,124 @@ func parseIpsec[T metrics](reader io.Reader, nFields int, fieldSetter func(peer[
 	return peers, nil
 }
 
-func parseIpsecTraffic(reader io.Reader, username2peer map[string]string) (peer[traffic], error) {
-	return parseIpsec(reader, 5, func(peers peer[traffic], fields []string) error {
-		peers[username2peer[fields[0]]] = map[string]traffic{
-			protoIPsec: {
-				Received: fields[2],
-				Sent:     fields[4],
-			},
+// accelProtos - mapping accel-ppp session type -> protocol name.
+var accelProtos = map[string]string{
+	"l2tp":  protoL2TP,
+	"sstp":  protoSSTP,
+	"pptp":  protoPPTP,
+	"pppoe": protoPPPoE,
+	"ikev2": protoIKEv2,
+}
+
+// accelProto - protocol name of the accel-ppp session type,
+// unknown types are reported as ipsec.
+func accelProto(typ string) string {
+	if proto, ok := accelProtos[strings.ToLower(typ)]; ok {
+		return proto
+	}
+
+	debugLog("unknown accel-ppp session type:", typ)
+
+	return protoIPsec
+}
+
+// parseIpsecTraffic - parse accel-cmd sessions traffic, sessions of the same
+// peer and type are summed, sessions of unknown usernames are returned as unattributed.
+func parseIpsecTraffic(reader io.Reader, username2peer map[string]string) (peer[traffic], unattributed, error) {
+	un := make(unattributed)
+	peers, err := parseIpsec(reader, 7, func(peers peer[traffic], fields []string) error {
+		t := traffic{
+			Received: fields[4],
+			Sent:     fields[6],
+		}
+		key, ok := username2peer[fields[0]]
+		if !ok {
+			un.add(accelProto(fields[2]), fields[0], t)
+			return nil
 		}
+		if _, ok := peers[key]; !ok {
+			peers[key] = make(map[string]traffic)
+		}
+		proto := accelProto(fields[2])
+		if existing, ok := peers[key][proto]; ok {
+			t = sumTraffic(existing, t)
+		}
+		peers[key][proto] = t
 		return nil
 	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return peers, un, nil
 }
 
 func parseIpsecEndpoints(reader io.Reader, username2peer map[string]string) (peer[endpoints], error) {
-	return parseIpsec(reader, 3, func(peers peer[endpoints], fields []string) error {
-		subnet, err := ipToSubnet(fields[2])
+	return parseIpsec(reader, 5, func(peers peer[endpoints], fields []string) error {
+		subnet, err := ipToSubnet(fields[4])
 		if err != nil {
-			return fmt.Errorf("get subnet from ip: %w", err)
+			// pppoe calling-sid is a mac address.
+			debugLog("get subnet from ip:", err)
+			return nil
+		}
+		key, ok := username2peer[fields[0]]
+		if !ok {
+			return nil
 		}
-		peers[username2peer[fields[0]]] = map[string]endpoints{
-			protoIPsec: {
-				Subnet: subnet,
-			},
+		if _, ok := peers[key]; !ok {
+			peers[key] = make(map[string]endpoints)
+		}
+		peers[key][accelProto(fields[2])] = endpoints{
+			Subnet: subnet,
 		}
 		return nil
 	})
 }
 
-func parseIpsecLastSeen(username2peer map[string]string) peer[lastSeen] {
+// assembleIpsecSessionLimits - chap-secrets limits are configured per user,
+// not per session type, so they are reported under every accel-ppp protocol
+// the peer has a session on, next to the traffic they limit.
+func assembleIpsecSessionLimits(configured peer[limits], sessions peer[traffic]) peer[limits] {
+	peers := make(peer[limits])
+	for p, protos := range sessions {
+		l, ok := configured[p][protoIPsec]
+		if !ok {
+			continue
+		}
+		peers[p] = make(map[string]limits)
+		for protoName := range protos {
+			peers[p][protoName] = l
+		}
+	}
+	return peers
+}
+
+// parseIpsecLastSeen - every online accel-ppp session is seen right now.
+func parseIpsecLastSeen(sessions peer[traffic]) peer[lastSeen] {
 	ts := strconv.FormatInt(time.Now().Unix(), 10)
 	peers := make(peer[lastSeen])
-	for _, p := range username2peer {
-		peers[p] = map[string]lastSeen{protoIPsec: {Timestamp: ts}}
+	for p, protos := range sessions {
+		peers[p] = make(map[string]lastSeen)
+		for protoName := range protos {
+			peers[p][protoName] = lastSeen{Timestamp: ts}
+		}
 	}
 	return peers
 }
 
-func getIpsecTraffic(username2peer map[string]string) (peer[traffic], error) {
-	stdout, err := runcmd("accel-cmd", "-4", "-t", "3", "show", "sessions", "username,rx-bytes-raw,tx-bytes-raw")
+func getIpsecTraffic(username2peer map[string]string) (peer[traffic], unattributed, error) {
+	stdout, err := runcmd("accel-cmd", "-4", "-t", "3", "show", "sessions", "username,type,rx-bytes-raw,tx-bytes-raw")
 	if err != nil {
-		return nil, fmt.Errorf("accel-cmd: %w", err)
+		return nil, nil, fmt.Errorf("accel-cmd: %w", err)
 	}
-	peers, err := parseIpsecTraffic(stdout, username2peer)
+	peers, un, err := parseIpsecTraffic(stdout, username2peer)
 	if err != nil {
-		return nil, fmt.Errorf("parse accel-cmd: %w", err)
+		return nil, nil, fmt.Errorf("parse accel-cmd: %w", err)
 	}
-	return peers, nil
+	return peers, un, nil
 }
 
 func getIpsecEndpoints(username2peer map[string]string) (peer[endpoints], error) {
-	stdout, err := runcmd("accel-cmd", "-4", "-t", "3", "show", "sessions", "username,calling-sid")
+	stdout, err := runcmd("accel-cmd", "-4", "-t", "3", "show", "sessions", "username,type,calling-sid")
 	if err != nil {
 		return nil, fmt.Errorf("accel-cmd: %w", err)
 	}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"io/fs"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -29,11 +30,83 @@ func TestIpsecTraffic(t *testing.T) {
 
 	defer file.Close()
 
-	peers, err := parseIpsecTraffic(file, username2peer)
+	peers, un, err := parseIpsecTraffic(file, username2peer)
 	if err != nil {
 		t.Fatal(err)
 	}
 
+	if _, ok := peers[""]; ok {
+		t.Errorf("unmapped session attributed to empty peer")
+	}
+
+	if tr := un[protoL2TP]["unknownUser00001"]; tr.Received != "11" || tr.Sent != "22" {
+		t.Errorf("unexpected unattributed traffic: %+v", tr)
+	}
+
+	if _, ok := peers[username2peer["XqKDba8uE2cynsYp"]][protoSSTP]; !ok {
+		t.Errorf("sstp session not found")
+	}
+
+	if _, ok := peers[username2peer["WwA8hhq4qKm4338Z"]][protoL2TP]; !ok {
+		t.Errorf("l2tp session not found")
+	}
+
+	res, err := json.MarshalIndent(peers, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(string(res))
+}
+
+func TestIpsecTrafficDuplicateSessions(t *testing.T) {
+	data := ` username | type | rx-bytes-raw | tx-bytes-raw
+----------+------+--------------+--------------
+user | l2tp | 100 | 500
+user | l2tp | 10 | 50
+user | sstp | 1 | 2
+`
+	peers, _, err := parseIpsecTraffic(strings.NewReader(data), map[string]string{"user": "key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tr := peers["key"][protoL2TP]; tr.Received != "110" || tr.Sent != "550" {
+		t.Errorf("unexpected l2tp traffic: %+v", tr)
+	}
+
+	if tr := peers["key"][protoSSTP]; tr.Received != "1" || tr.Sent != "2" {
+		t.Errorf("unexpected sstp traffic: %+v", tr)
+	}
+}
+
+func TestIpsecEndpoints(t *testing.T) {
+	rootFS, err := fs.Sub(ipsecTestDataFS, "test_data")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	username2peer := testGetIpsecSecret(t)
+
+	file, err := rootFS.Open("outputs/ipsec-endpoints.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer file.Close()
+
+	peers, err := parseIpsecEndpoints(file, username2peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ep := peers[username2peer["XqKDba8uE2cynsYp"]][protoSSTP]; ep.Subnet != "217.66.154.0/24" {
+		t.Errorf("sstp endpoint: expected %q, got %q", "217.66.154.0/24", ep.Subnet)
+	}
+
+	if _, ok := peers[username2peer["R5HRmrKf2wxVLn5x"]]; ok {
+		t.Errorf("pppoe endpoint must be skipped")
+	}
+
 	res, err := json.MarshalIndent(peers, "", "  ")
 	if err != nil {
 		t.Fatal(err)
@@ -55,26 +128,96 @@ func TestIpsecLastSeen(t *testing.T) {
 	t.Log(string(res))
 }
 
-/*
-func TestIpsecEndpoints(t *testing.T) {
-	username2peer := testGetIpsecSecret(t)
-	file, err := os.Open("accel-cmd.1.log")
+func TestIpsecSessionLimits(t *testing.T) {
+	l := limits{Down: "1024", Up: "2048"}
+	configured := peer[limits]{"key": {protoIPsec: l}, "offline": {protoIPsec: l}}
+	sessions := peer[traffic]{"key": {protoL2TP: {}, protoSSTP: {}}, "nolimits": {protoPPTP: {}}}
+
+	peers := assembleIpsecSessionLimits(configured, sessions)
+
+	if peers["key"][protoL2TP] != l || peers["key"][protoSSTP] != l {
+		t.Errorf("unexpected session limits: %+v", peers["key"])
+	}
+
+	if len(peers) != 1 {
+		t.Errorf("unexpected peers: %+v", peers)
+	}
+}
+
+func TestIpsecLimits(t *testing.T) {
+	rootFS, err := fs.Sub(ipsecTestDataFS, "test_data")
 	if err != nil {
 		t.Fatal(err)
 	}
+
+	file, err := rootFS.Open("etc/accel-ppp.chap-secrets." + ipsecTestWgi)
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	defer file.Close()
 
-	peers, err := parseIpsecEndpoints(file, username2peer)
+	_, peers, _, err := parseIpsecSecrets(file)
 	if err != nil {
 		t.Fatal(err)
 	}
+
+	l := peers["PUm+sS1B66VmjFHy4G7uWZYNP6gBSQrkOrsna8bYXis="][protoIPsec]
+	if l.Down != "10240" || l.Up != "10240" || l.Pool != "ip_pool_adm" {
+		t.Errorf("unexpected limits: %+v", l)
+	}
+
+	if l := peers["nmOqrxuL+jZPtcmDN5T2uOioAfgCVTgCxiD32k2YWag="][protoIPsec]; l.Pool != "" {
+		t.Errorf("unexpected default pool: %q", l.Pool)
+	}
+
 	res, err := json.MarshalIndent(peers, "", "  ")
 	if err != nil {
 		t.Fatal(err)
 	}
 	t.Log(string(res))
 }
-*/
+
+func TestIpsecSecretsTokenizer(t *testing.T) {
+	testData := `# Secrets for authentication using CHAP
+# client	server	secret	IP addresses
+
+"user one"	*	"secret with spaces"	*	1024/2048	#key1=
+user\ two * 'it''s' 10.0.0.2 # key2= comment
+user3 * pass#word * #key3=	comment
+"no-key" * "secret" *
+broken
+"unterminated * secret
+`
+	username2peer, peers, diag, err := parseIpsecSecrets(strings.NewReader(testData))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if username2peer["user one"] != "key1=" {
+		t.Errorf("user one: expected %q, got %q", "key1=", username2peer["user one"])
+	}
+
+	if username2peer["user two"] != "key2=" {
+		t.Errorf("user two: expected %q, got %q", "key2=", username2peer["user two"])
+	}
+
+	if username2peer["user3"] != "key3=" {
+		t.Errorf("user3: expected %q, got %q", "key3=", username2peer["user3"])
+	}
+
+	if l := peers["key1="][protoIPsec]; l.Down != "1024" || l.Up != "2048" {
+		t.Errorf("unexpected limits: %+v", l)
+	}
+
+	if diag.Skipped != 2 {
+		t.Errorf("skipped: expected 2, got %d", diag.Skipped)
+	}
+
+	if len(diag.Unmapped) != 1 || diag.Unmapped[0] != "no-key" {
+		t.Errorf("unexpected unmapped: %v", diag.Unmapped)
+	}
+}
 
 func testGetIpsecSecret(t *testing.T) map[string]string {
 	rootFS, err := fs.Sub(ipsecTestDataFS, "test_data")
@@ -89,7 +232,7 @@ func testGetIpsecSecret(t *testing.T) map[string]string {
 
 	defer file.Close()
 
-	username2peer, err := parseIpsecSecrets(file)
+	username2peer, _, _, err := parseIpsecSecrets(file)
 	if err != nil {
 		t.Fatal(err)
 	}
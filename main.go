@@ -2,21 +2,41 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/fs"
 	"log"
+	"net"
+	"net/netip"
 	"os"
 	"os/exec"
 	"strconv"
+	"strings"
 	"time"
+	"unicode"
 )
 
 const runCmd = "run"
 
 type appOptions struct {
-	rootFS fs.FS
-	wgi    string
+	rootFS   fs.FS
+	wgi      string
+	ovpnMgmt string
+	ovpnDirs []string
+	sessions bool
+	stateDir string
+	// authdbMaxAge - age of rotated authdb copies to read, disabled if 0.
+	authdbMaxAge time.Duration
+	// cloakSources - addresses or interfaces cloak connects to outline from.
+	cloakSources []string
+	// outlineInstances - outline instances besides the main one.
+	outlineInstances outlineInstances
+	// env - wg-quick namespace env of the interface.
+	env map[string]string
+	// envErr - env loading error, reported by the env users.
+	envErr error
 	stats  *stat
 }
 
@@ -53,6 +73,14 @@ func main() {
 	wgInterface := fl.String("wgi", "", "wg interface, e.g. wg0, required")
 	fl.BoolVar(&debug, "debug", false, "print errors to stderr, indented json output")
 	accelCmd := fl.Bool("accel-cmd", false, "accel-cmd data required")
+	stateDir := fl.String("state-dir", "", "directory to keep caches and state between runs, cloak traffic and the outline cloak split need it, disabled if empty")
+	listSessions := fl.Bool("sessions", false, "list individual sessions for diagnostic")
+	ovpnDirs := fl.String("openvpn-dirs", "", "plain openvpn instance directories with status.log and ccd, comma separated, relative to /, e.g. opt/openvpn-udp-wg0")
+	authdbMaxAge := fl.Duration("authdb-max-age", 0, "read rotated authdb logs (.1, .gz etc) modified within the age, e.g. 168h, disabled if 0")
+	cloakSrcs := fl.String("cloak-sources", "", "addresses or interfaces cloak connects to outline from, comma separated, loopback and EXT_IP are always included")
+	var outlines outlineInstances
+	fl.Var(&outlines, "outline", "additional outline instance: label,metrics-url,authdb-path, authdb path is relative to /, cloak fronted logins are cloak-<label>, may be repeated")
+	ovpnMgmt := fl.String("openvpn-mgmt", "", "openvpn management interface, [unix:]socket path relative to / or host:port, status file is used if empty or unavailable")
 
 	if args[0] != runCmd {
 		fl.Parse(args)
@@ -84,27 +112,61 @@ func main() {
 		os.Exit(1)
 	}
 
+	start := time.Now()
+
 	opts := &appOptions{
-		rootFS: os.DirFS("/"),
-		wgi:    *wgInterface,
+		rootFS:           os.DirFS("/"),
+		wgi:              *wgInterface,
+		ovpnMgmt:         *ovpnMgmt,
+		ovpnDirs:         splitList(*ovpnDirs),
+		sessions:         *listSessions,
+		stateDir:         *stateDir,
+		authdbMaxAge:     *authdbMaxAge,
+		cloakSources:     splitList(*cloakSrcs),
+		outlineInstances: outlines,
 		stats: &stat{
 			Code: "0",
 			Data: data{
 				Aggregated: aggregated{
 					protoWireguard:        1,
 					protoIPsec:            0,
+					protoL2TP:             0,
+					protoSSTP:             0,
+					protoPPTP:             0,
+					protoPPPoE:            0,
+					protoIKEv2:            0,
 					protoOpenVPNOverCloak: 0,
+					protoOpenVPN:          0,
 					protoOutline:          1,
-					protoOutlineOverCloak: 0,
+					protoOutlineOverCloak: 1,
 					protoProto0:           1,
 				},
-				Traffic:   make(peer[traffic]),
-				LastSeen:  make(peer[lastSeen]),
-				Endpoints: make(peer[endpoints]),
+				Traffic:         make(peer[traffic]),
+				LastSeen:        make(peer[lastSeen]),
+				Endpoints:       make(peer[endpoints]),
+				Limits:          make(peer[limits]),
+				Sessions:        make(peer[sessions]),
+				Upstream:        make(peer[traffic]),
+				Fronted:         make(peer[traffic]),
+				Activity:        make(peer[activity]),
+				Diagnostics:     make(diagnostics),
+				Unattributed:    make(unattributed),
+				Unauthenticated: make(map[string]unauthenticated),
+				Geo:             make(map[string]geo),
 			},
 		},
 	}
 
+	// the env error is reported by its users.
+	opts.env, opts.envErr = getWgQuickEnv(opts.rootFS, opts.wgi)
+	opts.stats.Endpoint = newEndpointInfo(opts.wgi, opts.env)
+
+	// outline instances are aggregated as the main one.
+	for _, inst := range opts.outlineInstances {
+		opts.stats.Data.Aggregated[inst.proto] = opts.stats.Data.Aggregated[protoOutline]
+		opts.stats.Data.Aggregated[inst.cloakProto()] = opts.stats.Data.Aggregated[protoOutlineOverCloak]
+	}
+
 	// wireguard
 	if err := handleWireGuard(opts); err != nil {
 		debugLog("wireguard:", err)
@@ -117,18 +179,29 @@ func main() {
 		}
 	}
 
-	cloakEndpoints, err := getCloakEndpointsMap(opts)
+	cloakEndpoints, cloakDiag, err := getCloakEndpointsMap(opts)
 	if err != nil {
 		debugLog("cloak endpoints:", err)
 	}
 
-	// cloak-openvpn
-	if err = handleOVC(opts, cloakEndpoints); err != nil {
-		debugLog("cloak-openvpn:", err)
+	opts.stats.Data.Diagnostics.add(protoCloak, cloakDiag)
+
+	// cloak uid -> wg public key of the openvpn clients.
+	ovcUIDs := make(map[string]string)
+
+	// cloak-openvpn, openvpn
+	if err = handleOVC(opts, cloakEndpoints, ovcUIDs); err != nil {
+		debugLog("openvpn:", err)
+	}
+
+	// cloak
+	cloakUsage, err := handleCloak(opts, cloakEndpoints, ovcUIDs)
+	if err != nil {
+		debugLog("cloak:", err)
 	}
 
-	// outline-ss
-	if err = handleOutline(opts, cloakEndpoints); err != nil {
+	// outline-ss, cloak-ss
+	if err = handleOutline(opts, cloakEndpoints, cloakUsage); err != nil {
 		debugLog("outline-ss:", err)
 	}
 
@@ -138,6 +211,7 @@ func main() {
 	}
 
 	opts.stats.Timestamp = strconv.FormatInt(time.Now().Unix(), 10)
+	opts.stats.Endpoint.Duration = strconv.FormatInt(time.Since(start).Milliseconds(), 10)
 
 	// output
 	encoder := json.NewEncoder(os.Stdout)
@@ -175,18 +249,25 @@ func handleIPSec(o *appOptions) error {
 
 	defer file.Close()
 
-	username2peer, err := parseIpsecSecrets(file)
+	username2peer, ipsecLimits, diag, err := parseIpsecSecrets(file)
 	if err != nil {
 		return fmt.Errorf("parse ipsec secrets: %w", err)
 	}
 
-	ipsecTraffic, err := getIpsecTraffic(username2peer)
+	o.stats.Data.Diagnostics.add(protoIPsec, diag)
+
+	mergePeers(o.stats.Data.Limits, ipsecLimits)
+
+	ipsecTraffic, ipsecUnattributed, err := getIpsecTraffic(username2peer)
 	if err != nil {
 		return fmt.Errorf("ipsec traffic: %w", err)
 	}
 
+	o.stats.Data.Unattributed.merge(ipsecUnattributed)
+
 	mergePeers(o.stats.Data.Traffic, ipsecTraffic)
-	mergePeers(o.stats.Data.LastSeen, parseIpsecLastSeen(username2peer))
+	mergePeers(o.stats.Data.LastSeen, parseIpsecLastSeen(ipsecTraffic))
+	mergePeers(o.stats.Data.Limits, assembleIpsecSessionLimits(ipsecLimits, ipsecTraffic))
 
 	ipsecEndpoints, err := getIpsecEndpoints(username2peer)
 	if err != nil {
@@ -198,76 +279,331 @@ func handleIPSec(o *appOptions) error {
 	return nil
 }
 
-func handleOVC(o *appOptions, cloakEndpoints map[string]string) error {
-	statusFile, err := o.rootFS.Open(fmt.Sprintf("opt/openvpn-%s/status.log", o.wgi))
+// handleOVC - the brigade openvpn instance behind cloak
+// and plain openvpn instances, cloak uid mapping is collected to uids.
+func handleOVC(o *appOptions, cloakEndpoints map[string]cloakEndpoint, uids map[string]string) error {
+	var errs []error
+
+	if err := handleOpenVPNInstance(o, fmt.Sprintf("opt/openvpn-%s", o.wgi), o.ovpnMgmt, protoOpenVPNOverCloak, cloakEndpoints, uids); err != nil {
+		errs = append(errs, err)
+	}
+
+	for _, dir := range o.ovpnDirs {
+		if err := handleOpenVPNInstance(o, dir, "", protoOpenVPN, cloakEndpoints, uids); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", dir, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// handleOpenVPNInstance - openvpn instance with status.log and ccd in dir,
+// clients on loopback come through cloak, others are plain openvpn.
+// Instance diagnostics are reported under diagProto.
+func handleOpenVPNInstance(o *appOptions, dir string, mgmt string, diagProto string, cloakEndpoints map[string]cloakEndpoint, uids map[string]string) error {
+	statusFile, err := openOpenVPNStatus(o.rootFS, dir, mgmt)
 	if err != nil {
-		return fmt.Errorf("openvpn status file: %w", err)
+		return fmt.Errorf("openvpn status: %w", err)
 	}
 
 	defer statusFile.Close()
 
-	peersReader, err := fs.ReadDir(o.rootFS, fmt.Sprintf("opt/openvpn-%s/ccd", o.wgi))
+	peersReader, err := fs.ReadDir(o.rootFS, dir+"/ccd")
 	if err != nil {
 		return fmt.Errorf("openvpn grep peers: %w", err)
 	}
 
-	cnMap, uidMap, err := getOVCPeerMaps(o.rootFS, fmt.Sprintf("opt/openvpn-%s/ccd", o.wgi), peersReader)
+	cache := make(ccdCache)
+	cacheName := stateFileName("ccd", dir)
+
+	if err := loadState(o.stateDir, cacheName, &cache); err != nil {
+		debugLog("openvpn ccd cache:", err)
+	}
+
+	cnMap, uidMap, diag, err := getOVCPeerMaps(o.rootFS, dir+"/ccd", peersReader, cache)
 	if err != nil {
 		return fmt.Errorf("openvpn peer maps: %w", err)
 	}
 
-	status, err := getOpenVPNStatus(statusFile, cnMap)
+	if err := saveState(o.stateDir, cacheName, cache); err != nil {
+		debugLog("openvpn ccd cache:", err)
+	}
+
+	o.stats.Data.Diagnostics.add(diagProto, diag)
+
+	for uid, key := range uidMap {
+		uids[uid] = key
+	}
+
+	statuses, updated, skipped, err := getOpenVPNStatus(statusFile, cnMap)
 	if err != nil {
 		return fmt.Errorf("parse openvpn status: %w", err)
 	}
 
-	mergePeers(o.stats.Data.Traffic, assembleOpenVPNTraffic(status))
-	mergePeers(o.stats.Data.LastSeen, assembleOpenVPNLastSeen(status))
+	o.stats.Data.Diagnostics.add(diagProto, diagnostic{Skipped: skipped})
+
+	transport, err := getOpenVPNTransport(o.rootFS, dir)
+	if err != nil {
+		debugLog("openvpn transport:", err)
+	}
+
+	// stale status is not a live activity, only the staleness is reported.
+	stale := isOpenVPNStatusStale(updated, time.Now())
+
+	for protoName, status := range statuses {
+		if stale {
+			o.stats.Data.Diagnostics.add(protoName, diagnostic{StaleSince: strconv.FormatInt(updated.Unix(), 10)})
 
-	ovpnEndpoints := assembleOVCEndpoints(cloakEndpoints, uidMap, status)
+			continue
+		}
+
+		o.stats.Data.Unattributed.merge(assembleOpenVPNUnattributed(status.unmapped, protoName, transport))
+
+		mergePeers(o.stats.Data.Traffic, assembleOpenVPNTraffic(status.peers, protoName, transport))
+		mergePeers(o.stats.Data.LastSeen, assembleOpenVPNLastSeen(status.peers, protoName))
 
-	mergePeers(o.stats.Data.Endpoints, ovpnEndpoints)
+		mergePeers(o.stats.Data.Sessions, assembleOpenVPNSessions(status.peers, protoName, o.sessions))
+
+		switch protoName {
+		case protoOpenVPNOverCloak:
+			mergePeers(o.stats.Data.Endpoints, assembleOVCEndpoints(cloakEndpoints, uidMap, status.peers))
+		default:
+			mergePeers(o.stats.Data.Endpoints, assembleOpenVPNEndpoints(status.peers))
+		}
+	}
 
 	return nil
 }
 
-func handleOutline(o *appOptions, cloakEndpoints map[string]string) error {
-	port, addr, err := getOutlinePortFromWgQuick(o.rootFS, o.wgi)
+// openOpenVPNStatus - live status from the management interface if configured,
+// falls back to the status file.
+func openOpenVPNStatus(myFS fs.FS, dir string, mgmt string) (io.ReadCloser, error) {
+	if mgmt != "" {
+		status, err := getOpenVPNMgmtStatus(mgmt)
+		if err == nil {
+			return io.NopCloser(status), nil
+		}
+
+		debugLog("openvpn management:", err)
+	}
+
+	statusFile, err := myFS.Open(dir + "/status.log")
 	if err != nil {
-		return fmt.Errorf("get outline port: %w", err)
+		return nil, fmt.Errorf("openvpn status file: %w", err)
+	}
+
+	return statusFile, nil
+}
+
+// handleOutline - the main outline instance from the wg-quick env and the
+// configured ones. Outline traffic of the main instance is split between
+// direct and cloak fronted connections using cloak usage, if the state is kept.
+func handleOutline(o *appOptions, cloakEndpoints map[string]cloakEndpoint, cloakUsage cloakUsageState) error {
+	var errs []error
+
+	port, addr := o.env["OUTLINE_SS_PORT"], o.env["EXT_IP"]
+	switch {
+	case o.envErr != nil:
+		errs = append(errs, fmt.Errorf("get outline port: wg-quick env: %w", o.envErr))
+	case port == "":
+		errs = append(errs, fmt.Errorf("get outline port: OUTLINE_SS_PORT not found"))
 	}
 
-	outlineTraffic, err := getOutlineTraffic(port)
+	// bad sources are skipped, loopback is cloak anyway.
+	sources, bad := outlineCloakSources(addr, o.cloakSources)
+	o.stats.Data.Diagnostics.add(protoOutline, diagnostic{Errors: bad})
+
+	uidMap, err := getCloakPeerMaps(o.rootFS, fmt.Sprintf("opt/cloak-%s/userinfo/userlist", o.wgi))
+	if err != nil {
+		debugLog("cloak peer maps:", err)
+	}
+
+	if port != "" {
+		main := outlineInstance{
+			proto:      protoOutline,
+			metricsURL: fmt.Sprintf("http://127.0.0.1:%s/metrics", port),
+			authdb:     fmt.Sprintf("opt/outline-ss-%s/authdb.log", o.wgi),
+		}
+
+		if err := handleOutlineInstance(o, main, sources, cloakUsage, uidMap); err != nil {
+			errs = append(errs, err)
+		}
+
+		// over cloak.
+
+		olcEndpoints, err := assembleOLCEndpoints(cloakEndpoints, uidMap)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("outline endpoints: %w", err))
+		}
+
+		mergePeers(o.stats.Data.Endpoints, olcEndpoints)
+	}
+
+	for _, inst := range o.outlineInstances {
+		if err := handleOutlineInstance(o, inst, sources, nil, nil); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", inst.proto, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// handleOutlineInstance - the instance data is reported under its protocol label,
+// cloak fronted logins under its cloak label.
+func handleOutlineInstance(o *appOptions, inst outlineInstance, sources cloakSources, cloakUsage cloakUsageState, uidMap map[string]string) error {
+	outlineMetrics, err := fetchOutlineMetrics(inst.metricsURL)
 	if err != nil {
 		return fmt.Errorf("traffic: %w", err)
 	}
 
-	mergePeers(o.stats.Data.Traffic, outlineTraffic)
+	outlineTraffic := outlineMetrics.traffic
+
+	o.stats.Data.Diagnostics.add(inst.proto, outlineMetrics.diag)
+	if un := outlineMetrics.unauthenticated; un.Sent != "" || un.Connections != "" {
+		o.stats.Data.Unauthenticated[inst.proto] = un
+	}
+	mergePeers(o.stats.Data.Upstream, relabelPeers(outlineMetrics.upstream, protoOutline, inst.proto))
+	mergePeers(o.stats.Data.Activity, relabelPeers(outlineMetrics.activity, protoOutline, inst.proto))
+
+	if outlineMetrics.geo.Location != nil || outlineMetrics.geo.ASN != nil {
+		o.stats.Data.Geo[inst.proto] = outlineMetrics.geo
+	}
+
+	if cloakUsage != nil {
+		state := make(outlineSplitState)
+		stateName := stateFileName("outline-split", o.wgi)
+
+		if err := loadState(o.stateDir, stateName, &state); err != nil {
+			return fmt.Errorf("load split: %w", err)
+		}
+
+		splitOutlineTraffic(state, outlineTraffic, cloakUsage, uidMap)
 
-	outlineLastSeen, outlineCloakLastSeen, outlineEndpoints, err := getOutlineLastSeenAndEndpoints(o.rootFS, o.wgi, addr)
+		if err := saveState(o.stateDir, stateName, state); err != nil {
+			return fmt.Errorf("save split: %w", err)
+		}
+
+		outlineTraffic = assembleOutlineSplitTraffic(state, outlineTraffic)
+	}
+
+	mergePeers(o.stats.Data.Traffic, relabelOutline(outlineTraffic, inst))
+
+	tail, err := readAuthDBTail(o, inst.proto, func(st *authdbTail) error {
+		return getOutlineLastSeenAndEndpoints(o.rootFS, inst.authdb, sources, o.authdbMaxAge, st)
+	})
 	if err != nil {
 		return fmt.Errorf("last seen and endpoints: %w", err)
 	}
 
-	mergePeers(o.stats.Data.LastSeen, outlineLastSeen)
-	mergePeers(o.stats.Data.LastSeen, outlineCloakLastSeen)
-	mergePeers(o.stats.Data.Endpoints, outlineEndpoints)
+	o.stats.Data.Diagnostics.add(inst.proto, diagnostic{Errors: tail.failed})
+	mergePeers(o.stats.Data.LastSeen, relabelOutline(tail.LastSeen, inst))
+	mergePeers(o.stats.Data.Endpoints, relabelOutline(tail.Endpoints, inst))
+
+	return nil
+}
 
-	// over cloak.
+// outlineCloakSources - cloak sources are external ips (EXT_IP may be a list)
+// and the configured addresses or interfaces. Sources which can't be
+// resolved are skipped and returned as diagnostic errors.
+func outlineCloakSources(extIPs string, configured []string) (cloakSources, []string) {
+	var bad []string
 
+	addrs := strings.FieldsFunc(extIPs, func(r rune) bool { return r == ',' || unicode.IsSpace(r) })
+
+	for _, item := range configured {
+		if _, err := netip.ParseAddr(item); err == nil {
+			addrs = append(addrs, item)
+
+			continue
+		}
+
+		ifaddrs, err := interfaceAddrs(item)
+		if err != nil {
+			debugLog("cloak source:", item, err)
+			bad = append(bad, fmt.Sprintf("cloak source %s: %s", item, err))
+
+			continue
+		}
+
+		addrs = append(addrs, ifaddrs...)
+	}
+
+	sources, invalid := newCloakSources(addrs...)
+	for _, a := range invalid {
+		debugLog("cloak source: invalid address:", a)
+		bad = append(bad, fmt.Sprintf("cloak source %s: invalid address", a))
+	}
+
+	return sources, bad
+}
+
+// interfaceAddrs - addresses of the interface.
+func interfaceAddrs(name string) ([]string, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("get interface: %w", err)
+	}
+
+	list, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("get addrs: %w", err)
+	}
+
+	addrs := make([]string, 0, len(list))
+	for _, a := range list {
+		if prefix, err := netip.ParsePrefix(a.String()); err == nil {
+			addrs = append(addrs, prefix.Addr().String())
+		}
+	}
+
+	return addrs, nil
+}
+
+// handleCloak - cloak last seen from the authdb and fronted traffic from the cloak
+// user database, ovcUIDs is an openvpn part of the cloak uid mapping.
+// Return cloak usage if the state is kept.
+func handleCloak(o *appOptions, cloakEndpoints map[string]cloakEndpoint, ovcUIDs map[string]string) (cloakUsageState, error) {
 	uidMap, err := getCloakPeerMaps(o.rootFS, fmt.Sprintf("opt/cloak-%s/userinfo/userlist", o.wgi))
 	if err != nil {
-		return fmt.Errorf("cloak peer maps: %w", err)
+		debugLog("cloak peer maps:", err)
+	}
+
+	for uid, key := range ovcUIDs {
+		if _, ok := uidMap[uid]; !ok {
+			uidMap[uid] = key
+		}
 	}
 
-	olcEndpoints, err := assembleOLCEndpoints(cloakEndpoints, uidMap)
+	mergePeers(o.stats.Data.LastSeen, assembleCloakLastSeen(cloakEndpoints, uidMap))
+
+	credits, err := readCloakUserDB(o.rootFS, fmt.Sprintf("opt/cloak-%s/userinfo/userinfo.db", o.wgi))
 	if err != nil {
-		return fmt.Errorf("outline endpoints: %w", err)
+		return nil, fmt.Errorf("user db: %w", err)
 	}
 
-	mergePeers(o.stats.Data.Endpoints, olcEndpoints)
+	mergePeers(o.stats.Data.Limits, assembleCloakLimits(credits, uidMap))
 
-	return nil
+	// usage is a sum of credit decreases between runs.
+	if o.stateDir == "" {
+		return nil, nil
+	}
+
+	state := make(cloakUsageState)
+	stateName := stateFileName("cloak", o.wgi)
+
+	if err := loadState(o.stateDir, stateName, &state); err != nil {
+		return nil, fmt.Errorf("load usage: %w", err)
+	}
+
+	updateCloakUsage(state, credits)
+
+	if err := saveState(o.stateDir, stateName, state); err != nil {
+		return nil, fmt.Errorf("save usage: %w", err)
+	}
+
+	mergePeers(o.stats.Data.Fronted, assembleCloakTraffic(state, uidMap))
+
+	return state, nil
 }
 
 func handleProto0(o *appOptions) error {
@@ -278,13 +614,37 @@ func handleProto0(o *appOptions) error {
 
 	mergePeers(o.stats.Data.Traffic, proto0Traffic)
 
-	proto0LastSeen, proto0Endpoints, err := getProto0LastSeenAndEndpoints(o.rootFS, o.wgi)
+	tail, err := readAuthDBTail(o, "xray", func(st *authdbTail) error {
+		return getProto0LastSeenAndEndpoints(o.rootFS, o.wgi, o.authdbMaxAge, st)
+	})
 	if err != nil {
 		return fmt.Errorf("last seen and endpoints: %w", err)
 	}
 
-	mergePeers(o.stats.Data.LastSeen, proto0LastSeen)
-	mergePeers(o.stats.Data.Endpoints, proto0Endpoints)
+	o.stats.Data.Diagnostics.add(protoProto0, diagnostic{Errors: tail.failed})
+	mergePeers(o.stats.Data.LastSeen, tail.LastSeen)
+	mergePeers(o.stats.Data.Endpoints, tail.Endpoints)
 
 	return nil
 }
+
+// readAuthDBTail - read the authdb with the tail state kept in the state dir,
+// without the state dir the whole authdb is read every run.
+func readAuthDBTail(o *appOptions, kind string, read func(*authdbTail) error) (*authdbTail, error) {
+	st := &authdbTail{}
+	stateName := stateFileName("authdb", kind+"-"+o.wgi)
+
+	if err := loadState(o.stateDir, stateName, st); err != nil {
+		return nil, fmt.Errorf("load tail: %w", err)
+	}
+
+	if err := read(st); err != nil {
+		return nil, err
+	}
+
+	if err := saveState(o.stateDir, stateName, st); err != nil {
+		return nil, fmt.Errorf("save tail: %w", err)
+	}
+
+	return st, nil
+}
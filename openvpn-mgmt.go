@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"strings"
+	"time"
+)
+
+const ovpnMgmtTimeout = 3 * time.Second
+
+// getOpenVPNMgmtStatus - query "status 3" from openvpn management interface,
+// addr is a unix socket path, optionally "unix:" prefixed, or host:port.
+// The result has the same format as status-version 3 file.
+func getOpenVPNMgmtStatus(addr string) (io.Reader, error) {
+	network, address := openVPNMgmtNetwork(addr)
+
+	conn, err := net.DialTimeout(network, address, ovpnMgmtTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("dial: %w", err)
+	}
+
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(ovpnMgmtTimeout)); err != nil {
+		return nil, fmt.Errorf("set deadline: %w", err)
+	}
+
+	if _, err := io.WriteString(conn, "status 3\n"); err != nil {
+		return nil, fmt.Errorf("write command: %w", err)
+	}
+
+	status, err := readOpenVPNMgmtResponse(conn)
+	if err != nil {
+		return nil, fmt.Errorf("read status: %w", err)
+	}
+
+	// not interested in the answer.
+	_, _ = io.WriteString(conn, "quit\n")
+
+	return status, nil
+}
+
+// openVPNMgmtNetwork - network and address to dial: "unix:" prefixed
+// and anything that is not host:port is a unix socket path relative to /.
+func openVPNMgmtNetwork(addr string) (string, string) {
+	if p, ok := strings.CutPrefix(addr, "unix:"); ok {
+		return "unix", path.Join("/", p)
+	}
+
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return "unix", path.Join("/", addr)
+	}
+
+	return "tcp", addr
+}
+
+// readOpenVPNMgmtResponse - read multi-line command response up to the "END" line,
+// real-time notifications (">...") are skipped.
+func readOpenVPNMgmtResponse(reader io.Reader) (io.Reader, error) {
+	buf := new(bytes.Buffer)
+	scanner := bufio.NewScanner(reader)
+
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+
+		switch {
+		case strings.HasPrefix(line, ">"):
+			continue
+		case strings.HasPrefix(line, "ERROR:"):
+			return nil, fmt.Errorf("management: %s", line)
+		case strings.HasPrefix(line, "ENTER PASSWORD:"):
+			return nil, fmt.Errorf("management: password is not supported")
+		}
+
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+
+		if line == "END" {
+			return buf, nil
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("scan response: %w", err)
+	}
+
+	return nil, fmt.Errorf("unexpected end of response")
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"embed"
+	"io"
+	"io/fs"
+	"net"
+	"testing"
+)
+
+//go:embed test_data
+var ovpnMgmtTestDataFS embed.FS
+
+// testOpenVPNMgmtServer - fake openvpn management interface,
+// answers "status 3" with the status-version 3 fixture.
+func testOpenVPNMgmtServer(t *testing.T) string {
+	rootFS, err := fs.Sub(ovpnMgmtTestDataFS, "test_data")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := fs.ReadFile(rootFS, "outputs/openvpn-status-v3.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+
+		defer conn.Close()
+
+		io.WriteString(conn, ">INFO:OpenVPN Management Interface Version 5 -- type 'help' for more info\r\n")
+
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			switch scanner.Text() {
+			case "status 3":
+				io.WriteString(conn, ">BYTECOUNT_CLI:0,100,200\r\n")
+				conn.Write(status)
+			case "quit":
+				return
+			default:
+				io.WriteString(conn, "ERROR: unknown command, enter 'help' for more options\r\n")
+			}
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+func TestOpenVPNMgmtStatus(t *testing.T) {
+	addr := testOpenVPNMgmtServer(t)
+
+	statusR, err := getOpenVPNMgmtStatus(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clients, _, _, err := extractOpenVPNStatus(statusR)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(clients) != 2 {
+		t.Fatalf("expected 2 clients, got %d", len(clients))
+	}
+
+	if c := clients[1]; c.commonName != "85b2f677-5bd1-4adc-93e0-9c1978b3744c" || c.bytesReceived != "33333" {
+		t.Errorf("unexpected client: %+v", c)
+	}
+}
+
+func TestOpenVPNMgmtNetwork(t *testing.T) {
+	for _, tc := range []struct{ addr, network, address string }{
+		{"127.0.0.1:7505", "tcp", "127.0.0.1:7505"},
+		{"[::1]:7505", "tcp", "[::1]:7505"},
+		{"/run/openvpn.sock", "unix", "/run/openvpn.sock"},
+		{"run/openvpn.sock", "unix", "/run/openvpn.sock"},
+		{"unix:run/openvpn:1.sock", "unix", "/run/openvpn:1.sock"},
+	} {
+		network, address := openVPNMgmtNetwork(tc.addr)
+		if network != tc.network || address != tc.address {
+			t.Errorf("%s: expected %s %s, got %s %s", tc.addr, tc.network, tc.address, network, address)
+		}
+	}
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// openvpn status file column names.
+const (
+	ovpnColCommonName         = "Common Name"
+	ovpnColRealAddress        = "Real Address"
+	ovpnColVirtualAddress     = "Virtual Address"
+	ovpnColBytesReceived      = "Bytes Received"
+	ovpnColBytesSent          = "Bytes Sent"
+	ovpnColConnectedSince     = "Connected Since"
+	ovpnColConnectedSinceUnix = "Connected Since (time_t)"
+	ovpnColClientID           = "Client ID"
+	ovpnColCipher             = "Data Channel Cipher"
+	ovpnColLastRef            = "Last Ref"
+	ovpnColLastRefUnix        = "Last Ref (time_t)"
+)
+
+// ovpnStatusMaxAge - status file older than this is stale,
+// openvpn rewrites it every --status interval (60s by default).
+const ovpnStatusMaxAge = 5 * time.Minute
+
+// ovpnTimeLayouts - openvpn status time formats,
+// the first one is used since 2.4, the second one is ctime.
+var ovpnTimeLayouts = []string{
+	time.DateTime,
+	time.ANSIC,
+}
+
+// ovpnDefaultClientColumns - client list columns of status version 2 and 3,
+// used if the status has no HEADER line.
+var ovpnDefaultClientColumns = []string{
+	ovpnColCommonName,
+	ovpnColRealAddress,
+	ovpnColVirtualAddress,
+	"Virtual IPv6 Address",
+	ovpnColBytesReceived,
+	ovpnColBytesSent,
+	ovpnColConnectedSince,
+	ovpnColConnectedSinceUnix,
+	"Username",
+	ovpnColClientID,
+	"Peer ID",
+	ovpnColCipher,
+}
+
+// ovpnDefaultRouteColumns - routing table columns of status version 2 and 3,
+// used if the status has no HEADER line.
+var ovpnDefaultRouteColumns = []string{
+	ovpnColVirtualAddress,
+	ovpnColCommonName,
+	ovpnColRealAddress,
+	ovpnColLastRef,
+	ovpnColLastRefUnix,
+}
+
+type openVPNStatus struct {
+	commonName         string
+	realAddress        string
+	virtualAddress     string
+	bytesReceived      string
+	bytesSent          string
+	connectedSince     string
+	connectedSinceUnix string
+	clientID           string
+	cipher             string
+	// lastRef - unix time of the last packet from the routing table.
+	lastRef string
+
+	// sessions - all sessions of the peer, if summed.
+	sessions []openVPNStatus
+}
+
+// openVPNRoute - routing table entry.
+type openVPNRoute struct {
+	commonName  string
+	realAddress string
+	lastRef     string
+}
+
+// connectedEarlier - session s is started before x.
+func (s openVPNStatus) connectedEarlier(x openVPNStatus) bool {
+	a, errA := strconv.ParseInt(s.connectedSinceUnix, 10, 64)
+	b, errB := strconv.ParseInt(x.connectedSinceUnix, 10, 64)
+
+	if errA == nil && errB == nil {
+		return a < b
+	}
+
+	// "2006-01-02 15:04:05" is ordered as a string.
+	return s.connectedSince < x.connectedSince
+}
+
+// session - single session for diagnostic.
+func (s openVPNStatus) session() session {
+	subnet, err := ipToSubnet(s.realAddress)
+	if err != nil {
+		debugLog("get subnet from ip:", err)
+	}
+
+	return session{
+		Subnet:         subnet,
+		Received:       s.bytesReceived,
+		Sent:           s.bytesSent,
+		ConnectedSince: s.connectedSinceUnix,
+	}
+}
+
+// parseOpenVPNRealAddress - parse openvpn real address:
+// "ip:port", "[ipv6]:port", "ip", optionally prefixed with
+// the address family "[AF_INET6]" or the protocol "udp6:".
+func parseOpenVPNRealAddress(s string) (netip.Addr, error) {
+	addr := s
+	if strings.HasPrefix(addr, "[AF_") {
+		if _, rest, ok := strings.Cut(addr, "]"); ok {
+			addr = rest
+		}
+	}
+
+	if proto, rest, ok := strings.Cut(addr, ":"); ok && (strings.HasPrefix(proto, "udp") || strings.HasPrefix(proto, "tcp")) {
+		addr = rest
+	}
+
+	if ap, err := netip.ParseAddrPort(addr); err == nil {
+		return ap.Addr().Unmap(), nil
+	}
+
+	if ip, err := netip.ParseAddr(addr); err == nil {
+		return ip.Unmap(), nil
+	}
+
+	return netip.Addr{}, fmt.Errorf("invalid real address: %q", s)
+}
+
+// getOpenVPNTransport - transport of the openvpn instance from the proto
+// directive of its config (*.conf in dir), openvpn defaults to udp.
+// Empty if there is no config.
+func getOpenVPNTransport(myFS fs.FS, dir string) (string, error) {
+	configs, err := fs.Glob(myFS, dir+"/*.conf")
+	if err != nil {
+		return "", fmt.Errorf("glob config: %w", err)
+	}
+
+	if len(configs) == 0 {
+		return "", nil
+	}
+
+	file, err := myFS.Open(configs[0])
+	if err != nil {
+		return "", fmt.Errorf("open config: %w", err)
+	}
+
+	defer file.Close()
+
+	transport, err := parseOpenVPNTransport(file)
+	if err != nil {
+		return "", fmt.Errorf("parse config: %w", err)
+	}
+
+	return transport, nil
+}
+
+// parseOpenVPNTransport - transport of the proto directive:
+// udp, udp4, udp6, tcp-server, tcp4-server etc.
+func parseOpenVPNTransport(reader io.Reader) (string, error) {
+	transport := transportUDP
+
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "proto" {
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(fields[1], transportUDP):
+			transport = transportUDP
+		case strings.HasPrefix(fields[1], transportTCP):
+			transport = transportTCP
+		default:
+			debugLog("openvpn config: unknown proto:", fields[1])
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("scanner error: %w", err)
+	}
+
+	return transport, nil
+}
+
+// ovpnColumns - column name -> index.
+type ovpnColumns map[string]int
+
+func newOVPNColumns(names []string) ovpnColumns {
+	c := make(ovpnColumns, len(names))
+	for i, name := range names {
+		c[name] = i
+	}
+
+	return c
+}
+
+func (c ovpnColumns) get(fields []string, name string) string {
+	idx, ok := c[name]
+	if !ok || idx >= len(fields) {
+		return ""
+	}
+
+	return fields[idx]
+}
+
+func (c ovpnColumns) client(fields []string) openVPNStatus {
+	return openVPNStatus{
+		commonName:         c.get(fields, ovpnColCommonName),
+		realAddress:        c.get(fields, ovpnColRealAddress),
+		virtualAddress:     c.get(fields, ovpnColVirtualAddress),
+		bytesReceived:      c.get(fields, ovpnColBytesReceived),
+		bytesSent:          c.get(fields, ovpnColBytesSent),
+		connectedSince:     c.get(fields, ovpnColConnectedSince),
+		connectedSinceUnix: ovpnUnixTime(c.get(fields, ovpnColConnectedSince), c.get(fields, ovpnColConnectedSinceUnix)),
+		clientID:           c.get(fields, ovpnColClientID),
+		cipher:             c.get(fields, ovpnColCipher),
+	}
+}
+
+func (c ovpnColumns) route(fields []string) openVPNRoute {
+	return openVPNRoute{
+		commonName:  c.get(fields, ovpnColCommonName),
+		realAddress: c.get(fields, ovpnColRealAddress),
+		lastRef:     ovpnUnixTime(c.get(fields, ovpnColLastRef), c.get(fields, ovpnColLastRefUnix)),
+	}
+}
+
+// ovpnUnixTime - unix time string from time_t column if present,
+// otherwise parse the local time column.
+func ovpnUnixTime(local, unix string) string {
+	if unix != "" {
+		return unix
+	}
+
+	if t := parseOVPNTime(local); !t.IsZero() {
+		return strconv.FormatInt(t.Unix(), 10)
+	}
+
+	return ""
+}
+
+// parseOVPNTime - parse openvpn local time, zero time if invalid.
+func parseOVPNTime(s string) time.Time {
+	for _, layout := range ovpnTimeLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t
+		}
+	}
+
+	return time.Time{}
+}
+
+// isOpenVPNStatusStale - status is not rewritten by openvpn for too long,
+// unknown update time is not stale.
+func isOpenVPNStatusStale(updated, now time.Time) bool {
+	return !updated.IsZero() && now.Sub(updated) > ovpnStatusMaxAge
+}
+
+// extractOpenVPNStatus - extract openvpn clients and status update time from reader,
+// ussually from "/opt/openvpn-%s/status.log".
+// Status only onlines, not offline.
+// The status-version 1, 2 (comma separated) and 3 (tab separated)
+// formats are detected automatically. Invalid lines are skipped and counted.
+func extractOpenVPNStatus(reader io.Reader) ([]openVPNStatus, time.Time, int, error) {
+	scanner := bufio.NewScanner(reader)
+
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return nil, time.Time{}, 0, fmt.Errorf("scan status: %w", err)
+		}
+
+		return nil, time.Time{}, 0, fmt.Errorf("empty status")
+	}
+
+	var (
+		clients []openVPNStatus
+		routes  []openVPNRoute
+		updated time.Time
+		skipped int
+		err     error
+	)
+
+	first := scanner.Text()
+
+	switch {
+	case first == "OpenVPN CLIENT LIST":
+		clients, routes, updated, skipped, err = extractOpenVPNStatusV1(scanner)
+	case strings.Contains(first, "\t"):
+		clients, routes, updated, err = extractOpenVPNStatusV2(first, scanner, "\t")
+	case strings.Contains(first, ","):
+		clients, routes, updated, err = extractOpenVPNStatusV2(first, scanner, ",")
+	default:
+		err = fmt.Errorf("unknown status format: %q", first)
+	}
+
+	if err != nil {
+		return nil, time.Time{}, 0, err
+	}
+
+	return joinOpenVPNRoutes(clients, routes), updated, skipped, nil
+}
+
+// joinOpenVPNRoutes - set clients last ref from the routing table,
+// match by common name and real address, or by common name only.
+func joinOpenVPNRoutes(clients []openVPNStatus, routes []openVPNRoute) []openVPNStatus {
+	byAddr := make(map[string]string)
+	byCN := make(map[string]string)
+
+	later := func(m map[string]string, k, ts string) {
+		if x, ok := m[k]; !ok || laterUnix(ts, x) {
+			m[k] = ts
+		}
+	}
+
+	for _, r := range routes {
+		if r.lastRef == "" {
+			continue
+		}
+
+		later(byAddr, r.commonName+","+r.realAddress, r.lastRef)
+		later(byCN, r.commonName, r.lastRef)
+	}
+
+	for i, c := range clients {
+		if ts, ok := byAddr[c.commonName+","+c.realAddress]; ok {
+			clients[i].lastRef = ts
+
+			continue
+		}
+
+		clients[i].lastRef = byCN[c.commonName]
+	}
+
+	return clients
+}
+
+// laterUnix - unix time string a is later than b.
+func laterUnix(a, b string) bool {
+	x, errA := strconv.ParseInt(a, 10, 64)
+	y, errB := strconv.ParseInt(b, 10, 64)
+
+	return errA == nil && (errB != nil || x > y)
+}
+
+// extractOpenVPNStatusV1 - status-version 1, sections are separated
+// by titles and the first line of the section is a column header.
+// Lines not matching the header are skipped and counted.
+func extractOpenVPNStatusV1(scanner *bufio.Scanner) ([]openVPNStatus, []openVPNRoute, time.Time, int, error) {
+	const (
+		sectionNone = iota
+		sectionClients
+		sectionRoutes
+	)
+
+	var (
+		clients []openVPNStatus
+		routes  []openVPNRoute
+		updated time.Time
+		columns ovpnColumns
+		section int
+		found   bool
+		skipped int
+	)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		switch {
+		case strings.HasPrefix(line, "Updated,"):
+			updated = parseOVPNTime(strings.TrimPrefix(line, "Updated,"))
+
+			continue
+		case strings.HasPrefix(line, ovpnColCommonName+","):
+			columns = newOVPNColumns(strings.Split(line, ","))
+			section, found = sectionClients, true
+
+			continue
+		case line == "ROUTING TABLE":
+			// the next line is a header.
+			if scanner.Scan() {
+				columns = newOVPNColumns(strings.Split(scanner.Text(), ","))
+			}
+
+			section = sectionRoutes
+
+			continue
+		case line == "GLOBAL STATS" || line == "END":
+			section = sectionNone
+
+			continue
+		}
+
+		if section == sectionNone {
+			continue
+		}
+
+		fields := strings.Split(line, ",")
+		if len(fields) != len(columns) {
+			debugLog("openvpn status: invalid line:", line)
+			skipped++
+
+			continue
+		}
+
+		switch section {
+		case sectionClients:
+			clients = append(clients, columns.client(fields))
+		case sectionRoutes:
+			routes = append(routes, columns.route(fields))
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, nil, time.Time{}, 0, fmt.Errorf("scan status: %w", err)
+	}
+
+	if !found {
+		return nil, nil, time.Time{}, 0, fmt.Errorf("%q header not found", ovpnColCommonName)
+	}
+
+	return clients, routes, updated, skipped, nil
+}
+
+// extractOpenVPNStatusV2 - status-version 2 and 3, every line starts
+// with a row type, HEADER lines describe the columns of the row type.
+func extractOpenVPNStatusV2(first string, scanner *bufio.Scanner, sep string) ([]openVPNStatus, []openVPNRoute, time.Time, error) {
+	var (
+		clients []openVPNStatus
+		routes  []openVPNRoute
+		updated time.Time
+	)
+
+	clientColumns := newOVPNColumns(ovpnDefaultClientColumns)
+	routeColumns := newOVPNColumns(ovpnDefaultRouteColumns)
+
+	for line := first; ; line = scanner.Text() {
+		fields := strings.Split(line, sep)
+
+		switch fields[0] {
+		case "HEADER":
+			if len(fields) > 2 {
+				switch fields[1] {
+				case "CLIENT_LIST":
+					clientColumns = newOVPNColumns(fields[2:])
+				case "ROUTING_TABLE":
+					routeColumns = newOVPNColumns(fields[2:])
+				}
+			}
+		case "TIME":
+			// TIME,<local time>,<time_t>
+			if len(fields) > 2 {
+				if ts, err := strconv.ParseInt(fields[2], 10, 64); err == nil {
+					updated = time.Unix(ts, 0)
+				}
+			}
+		case "CLIENT_LIST":
+			clients = append(clients, clientColumns.client(fields[1:]))
+		case "ROUTING_TABLE":
+			routes = append(routes, routeColumns.route(fields[1:]))
+		}
+
+		if !scanner.Scan() {
+			break
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, nil, time.Time{}, fmt.Errorf("scan status: %w", err)
+	}
+
+	return clients, routes, updated, nil
+}
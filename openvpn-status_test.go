@@ -0,0 +1,141 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"strings"
+	"testing"
+	"time"
+)
+
+//go:embed test_data
+var ovpnStatusTestDataFS embed.FS
+
+func TestExtractOpenVPNStatusVersions(t *testing.T) {
+	rootFS, err := fs.Sub(ovpnStatusTestDataFS, "test_data")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name, path string
+	}{
+		{"v1", fmt.Sprintf("opt/openvpn-%s/status.log", ovcTestWgi)},
+		{"v2", "outputs/openvpn-status-v2.log"},
+		{"v3", "outputs/openvpn-status-v3.log"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			file, err := rootFS.Open(tc.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer file.Close()
+
+			clients, updated, _, err := extractOpenVPNStatus(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if updated.IsZero() {
+				t.Errorf("status update time not found")
+			}
+
+			if len(clients) < 2 {
+				t.Fatalf("expected at least 2 clients, got %d", len(clients))
+			}
+
+			c := clients[0]
+			if c.commonName != "5bdb0d91-9195-4fcf-a264-c1feb1a3b0fe" || c.bytesReceived != "20530" || c.bytesSent != "26632" || c.connectedSince != "2024-07-20 23:28:28" {
+				t.Errorf("unexpected client: %+v", c)
+			}
+
+			want := "1721518108"
+			if tc.name == "v1" {
+				// local time without time_t column.
+				want = ovpnUnixTime("2024-07-20 23:28:28", "")
+			}
+
+			if c.lastRef != want || c.connectedSinceUnix != want {
+				t.Errorf("unexpected times: last ref %q, connected since %q, want %q", c.lastRef, c.connectedSinceUnix, want)
+			}
+
+			if tc.name != "v1" && (c.virtualAddress != "100.126.0.2" || c.connectedSinceUnix != "1721518108" || c.cipher != "AES-256-GCM") {
+				t.Errorf("unexpected extra columns: %+v", c)
+			}
+		})
+	}
+}
+
+func TestOpenVPNStatusStale(t *testing.T) {
+	now := time.Now()
+
+	testCases := []struct {
+		updated time.Time
+		stale   bool
+	}{
+		{time.Time{}, false},
+		{now.Add(-time.Minute), false},
+		{now.Add(-time.Hour), true},
+	}
+
+	for _, tc := range testCases {
+		if stale := isOpenVPNStatusStale(tc.updated, now); stale != tc.stale {
+			t.Errorf("updated %s: expected stale %v, got %v", tc.updated, tc.stale, stale)
+		}
+	}
+}
+
+func TestOpenVPNTransport(t *testing.T) {
+	rootFS, err := fs.Sub(ovpnStatusTestDataFS, "test_data")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if transport, err := getOpenVPNTransport(rootFS, "opt/openvpn-wg7"); err != nil || transport != transportTCP {
+		t.Errorf("instance transport: expected %q, got %q, %v", transportTCP, transport, err)
+	}
+
+	if transport, err := getOpenVPNTransport(rootFS, "opt/openvpn-none"); err != nil || transport != "" {
+		t.Errorf("instance without config: expected no transport, got %q, %v", transport, err)
+	}
+
+	testCases := []struct {
+		config, transport string
+	}{
+		{"dev tun\n", transportUDP},
+		{"proto udp6\n", transportUDP},
+		{"# proto tcp\nproto tcp4-server\n", transportTCP},
+	}
+
+	for _, tc := range testCases {
+		if transport, err := parseOpenVPNTransport(strings.NewReader(tc.config)); err != nil || transport != tc.transport {
+			t.Errorf("%q: expected %q, got %q, %v", tc.config, tc.transport, transport, err)
+		}
+	}
+}
+
+func TestExtractOpenVPNStatusV1Skipped(t *testing.T) {
+	data := `OpenVPN CLIENT LIST
+Updated,2024-07-20 23:28:55
+Common Name,Real Address,Bytes Received,Bytes Sent,Connected Since
+cn1,203.0.113.7:1194,100,200,2024-07-20 23:28:28
+cn2,broken
+ROUTING TABLE
+Virtual Address,Common Name,Real Address,Last Ref
+100.126.0.3,cn1,203.0.113.7:1194,2024-07-20 23:28:28
+GLOBAL STATS
+END
+`
+	clients, _, skipped, err := extractOpenVPNStatus(strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(clients) != 1 || skipped != 1 {
+		t.Errorf("expected 1 client and 1 skipped line, got %d and %d", len(clients), skipped)
+	}
+}
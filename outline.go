@@ -2,12 +2,18 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/base64"
 	"fmt"
 	"io"
 	"io/fs"
+	"math"
+	"mime"
 	"net/http"
+	"net/netip"
+	"net/url"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -16,22 +22,327 @@ import (
 	"github.com/prometheus/common/expfmt"
 )
 
-func getOutlinePortFromWgQuick(myFS fs.FS, wgi string) (string, string, error) {
-	filePath := fmt.Sprintf("etc/wg-quick-ns.env.%s", wgi)
+// outlineInstance - outline-ss-server instance.
+type outlineInstance struct {
+	// proto - protocol label of the instance data.
+	proto      string
+	metricsURL string
+	// authdb - authdb path relative to /.
+	authdb string
+}
 
-	port, addr, err := getOutlineSSPortAndPublicIP(myFS, filePath)
-	if err != nil {
-		return "", "", fmt.Errorf("failed to get OUTLINE_SS_PORT: %w", err)
+// cloakProto - protocol label of the cloak fronted instance data:
+// cloak-ss for the main instance, cloak-<label> for others.
+func (inst outlineInstance) cloakProto() string {
+	if inst.proto == protoOutline {
+		return protoOutlineOverCloak
+	}
+
+	return "cloak-" + inst.proto
+}
+
+// relabelOutline - move outline-ss and cloak-ss data to the instance labels.
+func relabelOutline[T metrics](peers peer[T], inst outlineInstance) peer[T] {
+	return relabelPeers(relabelPeers(peers, protoOutline, inst.proto), protoOutlineOverCloak, inst.cloakProto())
+}
+
+// outlineInstances - additional outline instances, the flag value
+// is "label,metrics-url,authdb-path", the flag may be repeated.
+type outlineInstances []outlineInstance
+
+func (l *outlineInstances) String() string {
+	list := make([]string, 0, len(*l))
+	for _, inst := range *l {
+		list = append(list, strings.Join([]string{inst.proto, inst.metricsURL, inst.authdb}, ","))
+	}
+
+	return strings.Join(list, " ")
+}
+
+func (l *outlineInstances) Set(s string) error {
+	fields := splitList(s)
+	if len(fields) != 3 {
+		return fmt.Errorf("expected label,metrics-url,authdb-path: %q", s)
+	}
+
+	inst := outlineInstance{proto: fields[0], metricsURL: fields[1], authdb: strings.TrimPrefix(fields[2], "/")}
+
+	// the labels and their cloak labels must differ to merge instances.
+	if inst.proto == "" {
+		return fmt.Errorf("empty label: %q", s)
+	}
+
+	if slices.Contains(knownProtos, inst.proto) || slices.Contains(knownProtos, inst.cloakProto()) {
+		return fmt.Errorf("reserved label: %q", inst.proto)
 	}
 
-	return port, addr, nil
+	for _, x := range *l {
+		if x.proto == inst.proto || x.proto == inst.cloakProto() || x.cloakProto() == inst.proto {
+			return fmt.Errorf("duplicate label: %q", inst.proto)
+		}
+	}
+
+	if u, err := url.Parse(inst.metricsURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("invalid metrics url: %q", inst.metricsURL)
+	}
+
+	*l = append(*l, inst)
+
+	return nil
 }
 
 // var outlineTrafficRE = regexp.MustCompile(`shadowsocks_data_bytes\{access_key="(\S+)",dir="(c[<>]p)",proto="(?:tcp|udp)"} (\d\.\d+e\+\d{2})`)
-func parseOutlineTraffic(reader io.Reader) (peer[traffic], error) {
-	peerTrafficMap := make(map[string]struct{ sent, received int })
+
+// outlineMetrics - parsed outline metrics.
+type outlineMetrics struct {
+	// traffic - client side c<>p traffic by access key.
+	traffic peer[traffic]
+	// upstream - target side p<>t traffic by access key.
+	upstream peer[traffic]
+	// unauthenticated - c<>p traffic and connections without access key.
+	unauthenticated unauthenticated
+	// geo - c<>p traffic by client location and asn.
+	geo geo
+	// activity - tunnel time and tcp connections by access key.
+	activity peer[activity]
+	// diag - samples which are not counted or are counted inexactly.
+	diag diagnostic
+}
+
+// outlineBytes - sent is to the target side (c>p, p>t).
+type outlineBytes struct{ sent, received uint64 }
+
+// outlineCounters - byte counters by access key and transport.
+type outlineCounters struct {
+	total     map[string]outlineBytes
+	transport map[string]map[string]outlineBytes
+}
+
+func newOutlineCounters() *outlineCounters {
+	return &outlineCounters{
+		total:     make(map[string]outlineBytes),
+		transport: make(map[string]map[string]outlineBytes),
+	}
+}
+
+// add - add bytes, transport is kept only if it is tcp or udp.
+func (c *outlineCounters) add(accessKey, transport string, sent, received uint64) {
+	t := c.total[accessKey]
+	t.sent += sent
+	t.received += received
+	c.total[accessKey] = t
+
+	if transport != transportTCP && transport != transportUDP {
+		return
+	}
+
+	if _, ok := c.transport[accessKey]; !ok {
+		c.transport[accessKey] = make(map[string]outlineBytes)
+	}
+
+	x := c.transport[accessKey][transport]
+	x.sent += sent
+	x.received += received
+	c.transport[accessKey][transport] = x
+}
+
+// traffic - traffic of the access key with the transport breakdown.
+func (c *outlineCounters) traffic(accessKey string) traffic {
+	v := c.total[accessKey]
+
+	t := traffic{Sent: strconv.FormatUint(v.sent, 10), Received: strconv.FormatUint(v.received, 10)}
+	for name, x := range c.transport[accessKey] {
+		t.addTransport(name, x.received, x.sent)
+	}
+
+	return t
+}
+
+// outlineAccept - accepted metrics formats, the same preference as prometheus has.
+const outlineAccept = "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;q=0.7," +
+	"application/openmetrics-text;version=1.0.0;q=0.5," +
+	"text/plain;version=0.0.4;q=0.3," +
+	"*/*;q=0.1"
+
+// outlineMetricsFormat - metrics format from the response Content-Type,
+// ok is false if the format is unknown and the classic text is assumed.
+func outlineMetricsFormat(h http.Header) (expfmt.Format, bool) {
+	if mediatype, _, err := mime.ParseMediaType(h.Get("Content-Type")); err == nil && mediatype == expfmt.OpenMetricsType {
+		return expfmt.FmtOpenMetrics_1_0_0, true
+	}
+
+	if format := expfmt.ResponseFormat(h); format != expfmt.FmtUnknown {
+		return format, true
+	}
+
+	return expfmt.FmtText, false
+}
+
+// openMetricsToText - reduce OpenMetrics to the classic text exposition:
+// drop # EOF and # UNIT lines and exemplars, the new metric types are untyped,
+// sample timestamps are converted from seconds to milliseconds.
+// Counter samples keep the _total suffix, _created samples are separate families.
+func openMetricsToText(reader io.Reader) (io.Reader, error) {
+	buf := new(bytes.Buffer)
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if line == "# EOF" || strings.HasPrefix(line, "# UNIT ") {
+			continue
+		}
+
+		if !strings.HasPrefix(line, "#") {
+			line, _, _ = strings.Cut(line, " # ")
+			line = openMetricsSampleTimestamp(line)
+		}
+
+		// unknown, info, stateset etc.
+		if f := strings.Fields(line); len(f) == 4 && f[1] == "TYPE" {
+			switch f[3] {
+			case "counter", "gauge", "histogram", "summary":
+			default:
+				line = strings.Join([]string{f[0], f[1], f[2], "untyped"}, " ")
+			}
+		}
+
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("scan: %w", err)
+	}
+
+	return buf, nil
+}
+
+// openMetricsSampleTimestamp - convert the sample timestamp from float seconds
+// to integer milliseconds, an unparsable timestamp is dropped.
+func openMetricsSampleTimestamp(line string) string {
+	// label values may contain spaces.
+	head, rest := "", line
+	if i := strings.IndexByte(line, '{'); i != -1 {
+		end := openMetricsLabelsEnd(line, i)
+		if end == -1 {
+			return line
+		}
+
+		head, rest = line[:end+1], line[end+1:]
+	}
+
+	fields := strings.Fields(rest)
+	if head == "" {
+		if len(fields) == 0 {
+			return line
+		}
+
+		head, fields = fields[0], fields[1:]
+	}
+
+	if len(fields) != 2 {
+		return line
+	}
+
+	ts, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return head + " " + fields[0]
+	}
+
+	return head + " " + fields[0] + " " + strconv.FormatInt(int64(math.Round(ts*1000)), 10)
+}
+
+// openMetricsLabelsEnd - index of the closing brace of the label set
+// starting at i, quoted values may contain braces and escaped quotes.
+func openMetricsLabelsEnd(line string, i int) int {
+	quoted := false
+
+	for ; i < len(line); i++ {
+		switch c := line[i]; {
+		case quoted && c == '\\':
+			i++
+		case c == '"':
+			quoted = !quoted
+		case !quoted && c == '}':
+			return i
+		}
+	}
+
+	return -1
+}
+
+// outlineSampleValue - sample value of any type, OpenMetrics counter
+// samples with the _total suffix are decoded as untyped.
+func outlineSampleValue(m *io_prometheus_client.Metric) float64 {
+	switch {
+	case m.GetCounter() != nil:
+		return m.GetCounter().GetValue()
+	case m.GetUntyped() != nil:
+		return m.GetUntyped().GetValue()
+	default:
+		return m.GetGauge().GetValue()
+	}
+}
+
+// maxExactFloatInt - float64 integers above it are not all representable.
+const maxExactFloatInt = 1 << 53
+
+// outlineCounter - byte counter from the float sample, rounded to the nearest
+// integer. exact is false if the sample is fractional or beyond 2^53, where
+// the exporter can't represent every byte count. ok is false if the sample is
+// negative, NaN or doesn't fit uint64.
+func outlineCounter(v float64) (n uint64, exact, ok bool) {
+	// float64(math.MaxUint64) is 2^64, which doesn't fit.
+	if math.IsNaN(v) || v < 0 || v >= math.MaxUint64 {
+		return 0, false, false
+	}
+
+	r := math.Round(v)
+
+	return uint64(r), r == v && r <= maxExactFloatInt, true
+}
+
+// parseOutlineMetrics - parse c<>p outline traffic and p<>t upstream traffic,
+// the proto label is kept as a transport breakdown. Upstream traffic without
+// access key is dropped.
+func parseOutlineMetrics(reader io.Reader, format expfmt.Format) (outlineMetrics, error) {
+	client := newOutlineCounters()
+	upstream := newOutlineCounters()
+	locations := newOutlineCounters()
+	asns := newOutlineCounters()
+
+	// access key -> seconds and closed connections.
+	tunnelTime := make(map[string]uint64)
+	closed := make(map[string]uint64)
+
+	if format.FormatType() == expfmt.TypeOpenMetrics {
+		r, err := openMetricsToText(reader)
+		if err != nil {
+			return outlineMetrics{}, fmt.Errorf("openmetrics: %w", err)
+		}
+
+		reader = r
+	}
+
+	var diag diagnostic
+
+	// counter - sample value, inexact and invalid samples are counted.
+	counter := func(m *io_prometheus_client.Metric) (uint64, bool) {
+		n, exact, ok := outlineCounter(outlineSampleValue(m))
+		switch {
+		case !ok:
+			diag.Skipped++
+		case !exact:
+			diag.Inexact++
+		}
+
+		return n, ok
+	}
+
 	// Decode the metrics
-	decoder := expfmt.NewDecoder(reader, expfmt.OpenMetricsType)
+	decoder := expfmt.NewDecoder(reader, format)
 
 	for {
 		var mf io_prometheus_client.MetricFamily
@@ -40,144 +351,443 @@ func parseOutlineTraffic(reader io.Reader) (peer[traffic], error) {
 				break
 			}
 
-			return nil, fmt.Errorf("decode metrics: %w", err)
+			return outlineMetrics{}, fmt.Errorf("decode metrics: %w", err)
 		}
 
-		if mf.GetName() == "shadowsocks_data_bytes" {
+		switch strings.TrimSuffix(mf.GetName(), "_total") {
+		case "shadowsocks_data_bytes":
 			for _, m := range mf.GetMetric() {
-				labels := m.GetLabel()
-				var (
-					accessKey string
-					dir       string
-				)
-
-				for _, l := range labels {
-					switch l.GetName() {
-					case "access_key":
-						accessKey = l.GetValue()
-					case "dir":
-						dir = l.GetValue()
-					}
-				}
+				labels := outlineLabels(m)
+				accessKey, dir, transport := labels["access_key"], labels["dir"], labels["proto"]
 
-				if accessKey == "" || dir == "" {
+				if dir == "" {
 					continue
 				}
 
-				accessKey = strings.ReplaceAll(strings.ReplaceAll(accessKey, "-", "+"), "_", "/")
+				accessKey = outlineAccessKey(accessKey)
 
-				count := m.GetCounter().GetValue()
-
-				trfc, ok := peerTrafficMap[accessKey]
+				count, ok := counter(m)
 				if !ok {
-					trfc = struct{ sent, received int }{}
+					continue
 				}
 
 				switch dir {
 				case "c<p":
-					trfc.received += int(count)
+					client.add(accessKey, transport, 0, count)
 				case "c>p":
-					trfc.sent += int(count)
-				default:
+					client.add(accessKey, transport, count, 0)
+				case "p<t":
+					upstream.add(accessKey, transport, 0, count)
+				case "p>t":
+					upstream.add(accessKey, transport, count, 0)
+				}
+			}
+
+		case "shadowsocks_tunnel_time_seconds":
+			for _, m := range mf.GetMetric() {
+				// fractional seconds are not a precision loss.
+				n, _, ok := outlineCounter(outlineSampleValue(m))
+				if !ok {
+					diag.Skipped++
+
 					continue
 				}
 
-				peerTrafficMap[accessKey] = trfc
+				tunnelTime[outlineAccessKey(outlineLabels(m)["access_key"])] += n
+			}
+
+		case "shadowsocks_tcp_connections_closed":
+			// opened connections are reported per location only,
+			// closed ones of any status are counted per access key.
+			for _, m := range mf.GetMetric() {
+				labels := outlineLabels(m)
+				if _, ok := labels["access_key"]; !ok {
+					continue
+				}
+
+				n, ok := counter(m)
+				if !ok {
+					continue
+				}
+
+				closed[outlineAccessKey(labels["access_key"])] += n
+			}
+
+		case "shadowsocks_data_bytes_per_location":
+			// only the client side, the same as the access key traffic.
+			for _, m := range mf.GetMetric() {
+				labels := outlineLabels(m)
+				location, asn, transport := labels["location"], labels["asn"], labels["proto"]
+
+				if location == "" {
+					location = geoUnknown
+				}
+
+				if asn == "" {
+					asn = geoUnknown
+				}
+
+				count, ok := counter(m)
+				if !ok {
+					continue
+				}
+
+				switch labels["dir"] {
+				case "c<p":
+					locations.add(location, transport, 0, count)
+					asns.add(asn, transport, 0, count)
+				case "c>p":
+					locations.add(location, transport, count, 0)
+					asns.add(asn, transport, count, 0)
+				}
 			}
 		}
 	}
 
-	peers := make(peer[traffic])
-	for k, v := range peerTrafficMap {
-		peers[k] = map[string]traffic{protoOutline: {Sent: strconv.Itoa(v.sent), Received: strconv.Itoa(v.received)}}
+	res := outlineMetrics{
+		traffic:  make(peer[traffic]),
+		upstream: make(peer[traffic]),
+		activity: assembleOutlineActivity(tunnelTime, closed),
+		diag:     diag,
 	}
 
-	return peers, nil
+	if _, ok := client.total[""]; ok {
+		res.unauthenticated.traffic = client.traffic("")
+	}
+
+	if n, ok := closed[""]; ok {
+		res.unauthenticated.Connections = strconv.FormatUint(n, 10)
+	}
+
+	for k := range client.total {
+		if k == "" {
+			continue
+		}
+
+		res.traffic[k] = map[string]traffic{protoOutline: client.traffic(k)}
+	}
+
+	for k := range upstream.total {
+		if k == "" {
+			continue
+		}
+
+		res.upstream[k] = map[string]traffic{protoOutline: upstream.traffic(k)}
+	}
+
+	for k := range locations.total {
+		if res.geo.Location == nil {
+			res.geo.Location = make(map[string]traffic)
+		}
+
+		res.geo.Location[k] = locations.traffic(k)
+	}
+
+	for k := range asns.total {
+		if res.geo.ASN == nil {
+			res.geo.ASN = make(map[string]traffic)
+		}
+
+		res.geo.ASN[k] = asns.traffic(k)
+	}
+
+	return res, nil
+}
+
+// outlineAccessKey - url safe base64 access key to the std one.
+func outlineAccessKey(key string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(key, "-", "+"), "_", "/")
 }
 
-// getOutlineTraffic - get outline traffic from metrics endpoint,
-// return common and loopback traffic separately.
-func getOutlineTraffic(port string) (peer[traffic], error) {
+// assembleOutlineActivity - assemble activity by access key,
+// activity without access key is dropped.
+func assembleOutlineActivity(tunnelTime, closed map[string]uint64) peer[activity] {
+	peers := make(peer[activity])
+
+	set := func(key string, f func(*activity)) {
+		if key == "" {
+			return
+		}
+
+		a := peers[key][protoOutline]
+		f(&a)
+		peers[key] = map[string]activity{protoOutline: a}
+	}
+
+	for key, n := range tunnelTime {
+		set(key, func(a *activity) { a.ConnectedSeconds = strconv.FormatUint(n, 10) })
+	}
+
+	for key, n := range closed {
+		set(key, func(a *activity) { a.ClosedConnections = strconv.FormatUint(n, 10) })
+	}
+
+	return peers
+}
+
+// outlineLabels - label name -> value.
+func outlineLabels(m *io_prometheus_client.Metric) map[string]string {
+	labels := make(map[string]string, len(m.GetLabel()))
+	for _, l := range m.GetLabel() {
+		labels[l.GetName()] = l.GetValue()
+	}
+
+	return labels
+}
+
+// fetchOutlineMetrics - get outline metrics with the format negotiation.
+func fetchOutlineMetrics(url string) (outlineMetrics, error) {
 	// Create an HTTP client with a timeout
 	client := &http.Client{
 		Timeout: 3 * time.Second, // Set the timeout to 3 seconds
 	}
 
-	// Construct the URL
-	url := fmt.Sprintf("http://127.0.0.1:%s/metrics", port)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return outlineMetrics{}, fmt.Errorf("new request: %w", err)
+	}
+
+	req.Header.Set("Accept", outlineAccept)
 
 	// Make the GET request
-	resp, err := client.Get(url)
+	resp, err := client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("GET request failed: %w", err)
+		return outlineMetrics{}, fmt.Errorf("GET request failed: %w", err)
 	}
 
 	defer resp.Body.Close()
 
 	// Check for HTTP status errors
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		return outlineMetrics{}, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
 	}
 
-	peers, err := parseOutlineTraffic(resp.Body)
+	format, ok := outlineMetricsFormat(resp.Header)
+	if !ok {
+		debugLog("outline metrics: unknown content type, text assumed:", resp.Header.Get("Content-Type"))
+	}
+
+	res, err := parseOutlineMetrics(resp.Body, format)
 	if err != nil {
-		return nil, fmt.Errorf("parse outline traffic: %w", err)
+		return outlineMetrics{}, fmt.Errorf("parse outline metrics: %w", err)
 	}
 
-	return peers, nil
+	return res, nil
 }
 
-func getOutlineLastSeenAndEndpoints(myFS fs.FS, wgi string, addr string) (peer[lastSeen], peer[lastSeen], peer[endpoints], error) {
-	file, err := myFS.Open(fmt.Sprintf("opt/outline-ss-%s/authdb.log", wgi))
-	if err != nil {
-		return nil, nil, nil, fmt.Errorf("open authdb: %w", err)
+// getOutlineLastSeenAndEndpoints - read new authdb lines into the tail state,
+// cloak fronted logins are last seen of cloak-ss. Rotated authdb copies are
+// read if maxAge is set.
+func getOutlineLastSeenAndEndpoints(myFS fs.FS, path string, sources cloakSources, maxAge time.Duration, st *authdbTail) error {
+	parse := func(r io.Reader) (peer[lastSeen], peer[endpoints], error) {
+		ls, lsp, ep, err := parseOutlineAuthDBLastSeenAndEndpoints(r, sources)
+		if err != nil {
+			return nil, nil, fmt.Errorf("parse outline last seen and endpoints: %w", err)
+		}
+
+		return mergePeers(ls, lsp), ep, nil
 	}
 
-	defer file.Close()
+	if maxAge > 0 {
+		if err := readRotatedAuthDB(myFS, path, maxAge, st, parse); err != nil {
+			return fmt.Errorf("authdb: %w", err)
+		}
+	}
 
-	skip := make([]string, 0, 3)
-	subnet, err := ipToSubnet(addr)
-	if err != nil {
-		return nil, nil, nil, fmt.Errorf("get subnet from ip: %w", err)
+	if err := tailAuthDB(myFS, path, st, parse); err != nil {
+		return fmt.Errorf("authdb: %w", err)
 	}
 
-	skip = append(skip, subnet)
+	return nil
+}
 
-	subnet, err = ipToSubnet("127.0.0.1")
-	if err != nil {
-		return nil, nil, nil, fmt.Errorf("get subnet from ip: %w", err)
+func assembleOLCEndpoints(cloakEndpoints map[string]cloakEndpoint, uidMap map[string]string) (peer[endpoints], error) {
+	peers := make(peer[endpoints])
+
+	for uid, key := range uidMap {
+		if e, ok := cloakEndpoints[uid]; ok {
+			peers[key] = map[string]endpoints{protoOutlineOverCloak: {Subnet: e.subnet, Recent: e.subnets()}}
+		}
 	}
 
-	skip = append(skip, subnet)
+	return peers, nil
+}
 
-	subnet, err = ipToSubnet("::1")
-	if err != nil {
-		return nil, nil, nil, fmt.Errorf("get subnet from ip: %w", err)
+// outlineSplit - cloak fronted share of the outline traffic of the access key,
+// kept between runs. Counters are in the outline directions: sent is c>p,
+// received is c<p.
+type outlineSplit struct {
+	// the previous outline and cloak counters.
+	Sent        uint64 `json:"sent"`
+	Received    uint64 `json:"received"`
+	UDPSent     uint64 `json:"udp-sent,omitempty"`
+	UDPReceived uint64 `json:"udp-received,omitempty"`
+	CloakUp     uint64 `json:"cloak-up"`
+	CloakDown   uint64 `json:"cloak-down"`
+
+	// cloak share of the current outline counters, cloak is tcp only.
+	CloakSent     uint64 `json:"cloak-sent"`
+	CloakReceived uint64 `json:"cloak-received"`
+}
+
+// outlineSplitState - access key -> split.
+type outlineSplitState map[string]outlineSplit
+
+// splitOutlineTraffic - account the cloak share of outline traffic growth since
+// the previous run: the cloak usage growth of the access key uid is fronted by
+// cloak (but not more than the outline tcp growth). Traffic before the first run
+// is direct. A counter decrease is a restart, the counter is a growth itself and
+// the share starts over with it.
+// uidMap is cloak uid -> access key of outline users.
+func splitOutlineTraffic(state outlineSplitState, outline peer[traffic], usage cloakUsageState, uidMap map[string]string) {
+	cloakByKey := make(map[string]cloakUsage)
+	for uid, key := range uidMap {
+		if u, ok := usage[uid]; ok {
+			cloakByKey[key] = u
+		}
 	}
 
-	skip = append(skip, subnet)
+	for key := range state {
+		if _, ok := outline[key]; !ok {
+			delete(state, key)
+		}
+	}
 
-	ls, lsp, ep, err := parseOutlineAuthDBLastSeenAndEndpoints(file, skip)
-	if err != nil {
-		return nil, nil, nil, fmt.Errorf("parse outline last seen and endpoints: %w", err)
+	for key, protos := range outline {
+		t := protos[protoOutline]
+		sent, received := parseCounter(t.Sent), parseCounter(t.Received)
+		udp := t.Transport[transportUDP]
+		udpSent, udpReceived := parseCounter(udp.Sent), parseCounter(udp.Received)
+		cu := cloakByKey[key]
+
+		s, ok := state[key]
+		if !ok {
+			state[key] = outlineSplit{
+				Sent:        sent,
+				Received:    received,
+				UDPSent:     udpSent,
+				UDPReceived: udpReceived,
+				CloakUp:     cu.Up,
+				CloakDown:   cu.Down,
+			}
+
+			continue
+		}
+
+		if sent < s.Sent {
+			s.CloakSent = 0
+		}
+
+		if received < s.Received {
+			s.CloakReceived = 0
+		}
+
+		// client upload is outline c>p and cloak up.
+		dSent, dReceived := counterGrowth(s.Sent, sent), counterGrowth(s.Received, received)
+		uSent, uReceived := min(counterGrowth(s.UDPSent, udpSent), dSent), min(counterGrowth(s.UDPReceived, udpReceived), dReceived)
+
+		s.CloakSent += min(counterGrowth(s.CloakUp, cu.Up), dSent-uSent)
+		s.CloakReceived += min(counterGrowth(s.CloakDown, cu.Down), dReceived-uReceived)
+
+		s.Sent, s.Received, s.CloakUp, s.CloakDown = sent, received, cu.Up, cu.Down
+		s.UDPSent, s.UDPReceived = udpSent, udpReceived
+		state[key] = s
 	}
+}
 
-	return ls, lsp, ep, nil
+// counterGrowth - growth of the counter, a decrease is a restart.
+func counterGrowth(prev, cur uint64) uint64 {
+	if cur < prev {
+		return cur
+	}
+
+	return cur - prev
 }
 
-func assembleOLCEndpoints(cloakEndpoints map[string]string, uidMap map[string]string) (peer[endpoints], error) {
-	peers := make(peer[endpoints])
+// assembleOutlineSplitTraffic - outline-ss is the outline counter minus
+// the cloak share, cloak-ss is the share.
+func assembleOutlineSplitTraffic(state outlineSplitState, outline peer[traffic]) peer[traffic] {
+	peers := make(peer[traffic])
 
-	for uid, key := range uidMap {
-		if subnet, ok := cloakEndpoints[uid]; ok {
-			peers[key] = map[string]endpoints{protoOutlineOverCloak: {Subnet: subnet}}
+	for key, protos := range outline {
+		t := protos[protoOutline]
+		s := state[key]
+
+		sent, received := parseCounter(t.Sent), parseCounter(t.Received)
+		udp := t.Transport[transportUDP]
+		udpSent, udpReceived := parseCounter(udp.Sent), parseCounter(udp.Received)
+		cSent := min(s.CloakSent, sent-min(udpSent, sent))
+		cReceived := min(s.CloakReceived, received-min(udpReceived, received))
+
+		direct := traffic{
+			Sent:     strconv.FormatUint(sent-cSent, 10),
+			Received: strconv.FormatUint(received-cReceived, 10),
+		}
+
+		if len(t.Transport) > 0 {
+			direct.addTransport(transportTCP, received-min(udpReceived, received)-cReceived, sent-min(udpSent, sent)-cSent)
+			direct.addTransport(transportUDP, udpReceived, udpSent)
+		}
+
+		peers[key] = map[string]traffic{protoOutline: direct}
+
+		if cSent != 0 || cReceived != 0 {
+			cloak := traffic{
+				Sent:     strconv.FormatUint(cSent, 10),
+				Received: strconv.FormatUint(cReceived, 10),
+			}
+
+			if len(t.Transport) > 0 {
+				cloak.addTransport(transportTCP, cReceived, cSent)
+			}
+
+			peers[key][protoOutlineOverCloak] = cloak
 		}
 	}
 
-	return peers, nil
+	return peers
 }
 
-func parseOutlineAuthDBLastSeenAndEndpoints(reader io.Reader, skip []string) (peer[lastSeen], peer[lastSeen], peer[endpoints], error) {
+// cloakSources - exact source addresses of cloak connections to outline,
+// loopback addresses are always cloak.
+type cloakSources map[netip.Addr]struct{}
+
+// newCloakSources - cloak sources from the addresses, e.g. external ips,
+// invalid addresses are returned.
+func newCloakSources(addrs ...string) (cloakSources, []string) {
+	sources := make(cloakSources, len(addrs))
+
+	var invalid []string
+
+	for _, a := range addrs {
+		ip, err := netip.ParseAddr(a)
+		if err != nil {
+			invalid = append(invalid, a)
+
+			continue
+		}
+
+		sources[ip.Unmap()] = struct{}{}
+	}
+
+	return sources, invalid
+}
+
+// has - the connection from the ip is fronted by cloak.
+func (s cloakSources) has(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if ip.IsLoopback() {
+		return true
+	}
+
+	_, ok := s[ip]
+
+	return ok
+}
+
+// parseOutlineAuthDBLastSeenAndEndpoints - logins from cloak sources are
+// the last seen of cloak-ss, the other ones are direct outline-ss logins.
+func parseOutlineAuthDBLastSeenAndEndpoints(reader io.Reader, sources cloakSources) (peer[lastSeen], peer[lastSeen], peer[endpoints], error) {
 	ls := make(peer[lastSeen])
 	lsp := make(peer[lastSeen])
 	ep := make(peer[endpoints])
@@ -199,24 +809,20 @@ func parseOutlineAuthDBLastSeenAndEndpoints(reader io.Reader, skip []string) (pe
 			continue
 		}
 
-		subnet, err := ipToSubnet(fields[2])
+		ip, err := netip.ParseAddr(fields[2])
 		if err != nil {
-			return nil, nil, nil, fmt.Errorf("get subnet from ip: %w", err)
+			return nil, nil, nil, fmt.Errorf("parse ip: %w", err)
 		}
 
-		ignore := false
-		for _, s := range skip {
-			if subnet == s {
-				ignore = true
+		if sources.has(ip) {
+			lsp[pub] = map[string]lastSeen{protoOutlineOverCloak: {Timestamp: fields[3]}}
 
-				lsp[pub] = map[string]lastSeen{protoOutlineOverCloak: {Timestamp: fields[3]}}
-
-				break
-			}
+			continue
 		}
 
-		if ignore {
-			continue
+		subnet, err := ipToSubnet(fields[2])
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("get subnet from ip: %w", err)
 		}
 
 		ls[pub] = map[string]lastSeen{protoOutline: {Timestamp: fields[3]}}
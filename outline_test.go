@@ -1,11 +1,21 @@
 package main
 
 import (
+	"bytes"
 	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/fs"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
 	"testing"
+	"testing/fstest"
+
+	"github.com/prometheus/common/expfmt"
 )
 
 //go:embed test_data
@@ -24,11 +34,72 @@ func TestOutlineTraffic(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	peers, err := parseOutlineTraffic(file)
+	metrics, err := parseOutlineMetrics(file, expfmt.FmtText)
 	if err != nil {
 		t.Fatal(err)
 	}
 
+	peers, un := metrics.traffic, metrics.unauthenticated
+
+	if un.Sent != "112022" || un.Received != "0" || un.Connections != "50" {
+		t.Errorf("unexpected unauthenticated load: %+v", un)
+	}
+
+	if _, ok := peers[""]; ok {
+		t.Error("traffic without access key is reported as a peer")
+	}
+
+	tr := peers["nmOqrxuL+jZPtcmDN5T2uOioAfgCVTgCxiD32k2YWag="][protoOutline]
+	if x := tr.Transport[transportUDP]; x.Sent != "3333216" || x.Received != "36955473" {
+		t.Errorf("unexpected udp traffic: %+v", x)
+	}
+
+	if x := tr.Transport[transportTCP]; x.Sent != "1309097" || x.Received != "121017699" {
+		t.Errorf("unexpected tcp traffic: %+v", x)
+	}
+
+	up := metrics.upstream["e45JqFuA4yC78J9owAozUW9FVzxOWVxTNjU4fNp2auU="][protoOutline]
+	if up.Sent != "3374212" || up.Received != "154338012" {
+		t.Errorf("unexpected upstream traffic: %+v", up)
+	}
+
+	if _, ok := metrics.upstream[""]; ok {
+		t.Error("upstream traffic without access key is reported")
+	}
+
+	if x := metrics.geo.Location["DE"]; x.Sent != "300000" || x.Received != "2000000" || x.Transport[transportUDP].Sent != "50000" {
+		t.Errorf("unexpected DE traffic: %+v", x)
+	}
+
+	if x := metrics.geo.ASN["3320"]; x.Sent != "250000" || x.Received != "1500000" {
+		t.Errorf("unexpected AS3320 traffic: %+v", x)
+	}
+
+	if _, ok := metrics.geo.ASN[geoUnknown]; !ok {
+		t.Error("empty asn is not reported as unknown")
+	}
+
+	testCases := []struct {
+		key, seconds, connections string
+	}{
+		{"nmOqrxuL+jZPtcmDN5T2uOioAfgCVTgCxiD32k2YWag=", "3600", "12"},
+		{"e45JqFuA4yC78J9owAozUW9FVzxOWVxTNjU4fNp2auU=", "121", "7"},
+	}
+
+	for _, tc := range testCases {
+		if a := metrics.activity[tc.key][protoOutline]; a.ConnectedSeconds != tc.seconds || a.ClosedConnections != tc.connections {
+			t.Errorf("%s: unexpected activity: %+v", tc.key, a)
+		}
+	}
+
+	if _, ok := metrics.activity[""]; ok {
+		t.Error("activity without access key is reported")
+	}
+
+	if metrics.diag.Inexact != 0 || metrics.diag.Skipped != 0 {
+		t.Errorf("unexpected diagnostic: %+v", metrics.diag)
+	}
+
 	res, err := json.MarshalIndent(peers, "", "  ")
 	if err != nil {
 		t.Fatal(err)
@@ -48,10 +119,44 @@ func TestOutlineLastSeenAndEndpoints(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	ls, _, ep, err := parseOutlineAuthDBLastSeenAndEndpoints(file, []string{"127.0.0.1/24"})
+	// several external ips, the ipv6 one too.
+	sources, bad := outlineCloakSources("192.168.100.120, 2001:db8::1", nil)
+	if len(bad) != 0 {
+		t.Fatal(bad)
+	}
+
+	ls, lsp, ep, err := parseOutlineAuthDBLastSeenAndEndpoints(file, sources)
 	if err != nil {
 		t.Fatal(err)
 	}
+
+	testCases := []struct {
+		key    string
+		direct string
+		cloak  string
+	}{
+		// the server /24 is not cloak.
+		{"ZGlyZWN0LXNhbWUtMjQtdXNlci0wMDAwMDAwMDAwMDA=", "1720204200", ""},
+		{"Y2xvYWstZXh0LWlwLXVzZXItMDAwMDAwMDAwMDAwMDA=", "", "1720204260"},
+		{"aXB2Ni1kaXJlY3QtdXNlci0wMDAwMDAwMDAwMDAwMDA=", "1720204320", ""},
+		{"aXB2Ni1jbG9hay11c2VyLTAwMDAwMDAwMDAwMDAwMDA=", "", "1720204380"},
+		// direct and later over cloak on loopback.
+		{"nmOqrxuL+jZPtcmDN5T2uOioAfgCVTgCxiD32k2YWag=", "1720199389", "1720204440"},
+	}
+
+	for _, tc := range testCases {
+		if ts := ls[tc.key][protoOutline].Timestamp; ts != tc.direct {
+			t.Errorf("%s: unexpected direct last seen %q", tc.key, ts)
+		}
+
+		if ts := lsp[tc.key][protoOutlineOverCloak].Timestamp; ts != tc.cloak {
+			t.Errorf("%s: unexpected cloak last seen %q", tc.key, ts)
+		}
+	}
+
+	if subnet := ep["aXB2Ni1kaXJlY3QtdXNlci0wMDAwMDAwMDAwMDAwMDA="][protoOutline].Subnet; subnet != "2001:db8::/56" {
+		t.Errorf("unexpected ipv6 endpoint: %q", subnet)
+	}
 	res, err := json.MarshalIndent(ls, "", "  ")
 	if err != nil {
 		t.Fatal(err)
@@ -64,3 +169,366 @@ func TestOutlineLastSeenAndEndpoints(t *testing.T) {
 	}
 	t.Log(string(res))
 }
+
+func TestOutlineSplitTraffic(t *testing.T) {
+	outline := func(sent, received string) peer[traffic] {
+		return peer[traffic]{"key": {protoOutline: {Sent: sent, Received: received}}}
+	}
+
+	uidMap := map[string]string{"uid": "key"}
+	state := make(outlineSplitState)
+
+	// first run is direct.
+	splitOutlineTraffic(state, outline("100", "1000"), cloakUsageState{"uid": {Up: 10, Down: 10}}, uidMap)
+
+	// 50/500 of growth, 20/700 of cloak growth.
+	splitOutlineTraffic(state, outline("150", "1500"), cloakUsageState{"uid": {Up: 30, Down: 710}}, uidMap)
+
+	peers := assembleOutlineSplitTraffic(state, outline("150", "1500"))
+	if tr := peers["key"][protoOutline]; tr.Sent != "130" || tr.Received != "1000" {
+		t.Errorf("unexpected outline-ss traffic: %+v", tr)
+	}
+
+	if tr := peers["key"][protoOutlineOverCloak]; tr.Sent != "20" || tr.Received != "500" {
+		t.Errorf("unexpected cloak-ss traffic: %+v", tr)
+	}
+
+	// outline restart, the share starts over.
+	splitOutlineTraffic(state, outline("5", "5"), cloakUsageState{"uid": {Up: 30, Down: 710}}, uidMap)
+
+	want := outlineSplit{Sent: 5, Received: 5, CloakUp: 30, CloakDown: 710}
+
+	if got := state["key"]; got != want {
+		t.Errorf("unexpected split:\n got %+v\nwant %+v", got, want)
+	}
+
+	peers = assembleOutlineSplitTraffic(state, outline("5", "5"))
+	if tr := peers["key"][protoOutline]; tr.Sent != "5" || tr.Received != "5" {
+		t.Errorf("unexpected outline-ss traffic: %+v", tr)
+	}
+
+	if _, ok := peers["key"][protoOutlineOverCloak]; ok {
+		t.Errorf("unexpected cloak-ss traffic after restart")
+	}
+
+	splitOutlineTraffic(state, peer[traffic]{}, nil, uidMap)
+
+	if len(state) != 0 {
+		t.Errorf("removed key is not pruned: %+v", state)
+	}
+}
+
+func TestOutlineSplitTrafficTransport(t *testing.T) {
+	outline := func(sent, udpSent string) peer[traffic] {
+		tr := traffic{Sent: sent, Received: "0"}
+		tr.Transport = map[string]transfer{transportUDP: {Sent: udpSent, Received: "0"}}
+
+		return peer[traffic]{"key": {protoOutline: tr}}
+	}
+
+	uidMap := map[string]string{"uid": "key"}
+	state := make(outlineSplitState)
+
+	splitOutlineTraffic(state, outline("100", "40"), cloakUsageState{"uid": {}}, uidMap)
+
+	// 100 of growth, 80 of it is udp, cloak can't take more than 20 of tcp.
+	splitOutlineTraffic(state, outline("200", "120"), cloakUsageState{"uid": {Up: 50}}, uidMap)
+
+	peers := assembleOutlineSplitTraffic(state, outline("200", "120"))
+
+	if x := peers["key"][protoOutline]; x.Sent != "180" {
+		t.Errorf("unexpected outline-ss traffic: %+v", x)
+	}
+
+	if x := peers["key"][protoOutline].Transport; x[transportUDP].Sent != "120" || x[transportTCP].Sent != "60" {
+		t.Errorf("unexpected outline-ss transport: %+v", x)
+	}
+
+	if x := peers["key"][protoOutlineOverCloak]; x.Sent != "20" || x.Transport[transportTCP].Sent != "20" {
+		t.Errorf("unexpected cloak-ss traffic: %+v", x)
+	}
+}
+
+func TestOutlineMetricsFormats(t *testing.T) {
+	file, err := outlineTestDataFS.Open("test_data/outputs/outline-metrics.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer file.Close()
+
+	var parser expfmt.TextParser
+
+	families, err := parser.TextToMetricFamilies(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name   string
+		format expfmt.Format
+	}{
+		{"text", expfmt.FmtText},
+		{"openmetrics", expfmt.FmtOpenMetrics_1_0_0},
+		{"protobuf", expfmt.FmtProtoDelim},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			body := new(bytes.Buffer)
+			enc := expfmt.NewEncoder(body, tc.format)
+
+			for _, mf := range families {
+				if err := enc.Encode(mf); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if closer, ok := enc.(expfmt.Closer); ok {
+				if err := closer.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if !strings.Contains(r.Header.Get("Accept"), expfmt.OpenMetricsType) {
+					t.Errorf("unexpected accept: %q", r.Header.Get("Accept"))
+				}
+
+				w.Header().Set("Content-Type", string(tc.format))
+				w.Write(body.Bytes())
+			}))
+			defer srv.Close()
+
+			metrics, err := fetchOutlineMetrics(srv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tr := metrics.traffic["nmOqrxuL+jZPtcmDN5T2uOioAfgCVTgCxiD32k2YWag="][protoOutline]
+			if tr.Sent != "4642313" || tr.Received != "157973172" {
+				t.Errorf("unexpected traffic: %+v", tr)
+			}
+
+			if x := metrics.geo.Location["DE"]; x.Received != "2000000" {
+				t.Errorf("unexpected DE traffic: %+v", x)
+			}
+		})
+	}
+}
+
+func TestOutlineOpenMetricsTimestamps(t *testing.T) {
+	body := `# TYPE shadowsocks_data_bytes counter
+shadowsocks_data_bytes_total{access_key="key",dir="c>p",proto="tcp"} 10 1700000000.123
+shadowsocks_data_bytes_created{access_key="key",dir="c>p",proto="tcp"} 1699990000.5 1700000000.123
+shadowsocks_data_bytes_total{access_key="key",dir="c<p",proto="tcp"} 20 1700000000
+shadowsocks_data_bytes_created{access_key="key",dir="c<p",proto="tcp"} 1699990000.5
+# EOF
+`
+
+	metrics, err := parseOutlineMetrics(strings.NewReader(body), expfmt.FmtOpenMetrics_1_0_0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tr := metrics.traffic["key"][protoOutline]; tr.Sent != "10" || tr.Received != "20" {
+		t.Errorf("unexpected traffic: %+v", tr)
+	}
+
+	testCases := []struct {
+		line, want string
+	}{
+		{`a_total 1 1700000000.123`, `a_total 1 1700000000123`},
+		{`a_total{l="x } y"} 1 1.5`, `a_total{l="x } y"} 1 1500`},
+		{`a_total{l="\"}"} 1`, `a_total{l="\"}"} 1`},
+		{`a_total 1 bad`, `a_total 1`},
+	}
+
+	for _, tc := range testCases {
+		if got := openMetricsSampleTimestamp(tc.line); got != tc.want {
+			t.Errorf("%s: expected %q, got %q", tc.line, tc.want, got)
+		}
+	}
+}
+
+func TestOutlineMetricsFormat(t *testing.T) {
+	testCases := []struct {
+		contentType string
+		want        expfmt.FormatType
+		ok          bool
+	}{
+		{"text/plain; version=0.0.4; charset=utf-8", expfmt.TypeTextPlain, true},
+		{"application/openmetrics-text; version=1.0.0; charset=utf-8", expfmt.TypeOpenMetrics, true},
+		{"application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily; encoding=delimited", expfmt.TypeProtoDelim, true},
+		{"", expfmt.TypeTextPlain, false},
+	}
+
+	for _, tc := range testCases {
+		format, ok := outlineMetricsFormat(http.Header{"Content-Type": []string{tc.contentType}})
+		if format.FormatType() != tc.want || ok != tc.ok {
+			t.Errorf("%q: unexpected format %q, %v", tc.contentType, format, ok)
+		}
+	}
+}
+
+func TestOutlineCounterLimits(t *testing.T) {
+	testCases := []struct {
+		value     float64
+		want      uint64
+		exact, ok bool
+	}{
+		{1.21017699e+08, 121017699, true, true},
+		{1.5, 2, false, true},
+		{9007199254740992, 9007199254740992, true, true},            // 2^53
+		{9007199254740994, 9007199254740994, false, true},           // 2^53+2
+		{1.8446744073709550e+19, 18446744073709549568, false, true}, // the largest float64 below 2^64
+		{1.8446744073709552e+19, 0, false, false},                   // 2^64
+		{-1, 0, false, false},
+		{math.NaN(), 0, false, false},
+		{math.Inf(1), 0, false, false},
+	}
+
+	for _, tc := range testCases {
+		n, exact, ok := outlineCounter(tc.value)
+		if n != tc.want || exact != tc.exact || ok != tc.ok {
+			t.Errorf("%v: got %d, %v, %v", tc.value, n, exact, ok)
+		}
+	}
+
+	// 2^53 + 2^53 is summed without float rounding.
+	body := `# TYPE shadowsocks_data_bytes counter
+shadowsocks_data_bytes{access_key="key",dir="c>p",proto="tcp"} 9.007199254740992e+15
+shadowsocks_data_bytes{access_key="key",dir="c>p",proto="udp"} 9.007199254740994e+15
+shadowsocks_data_bytes{access_key="key",dir="c<p",proto="tcp"} -1
+`
+
+	metrics, err := parseOutlineMetrics(strings.NewReader(body), expfmt.FmtText)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tr := metrics.traffic["key"][protoOutline]; tr.Sent != "18014398509481986" || tr.Received != "0" {
+		t.Errorf("unexpected traffic: %+v", tr)
+	}
+
+	if metrics.diag.Inexact != 1 || metrics.diag.Skipped != 1 {
+		t.Errorf("unexpected diagnostic: %+v", metrics.diag)
+	}
+}
+
+func TestOutlineInstances(t *testing.T) {
+	var list outlineInstances
+
+	if err := list.Set("outline-ss2, http://127.0.0.1:9092/metrics, /opt/outline-ss2-wg7/authdb.log"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []string{
+		"outline-ss2,http://127.0.0.1:9093/metrics,opt/x/authdb.log", // duplicate
+		protoOutline + ",http://127.0.0.1:9093/metrics,opt/x/authdb.log",
+		"ss,http://127.0.0.1:9093/metrics,opt/x/authdb.log", // cloak-ss
+		protoL2TP + ",http://127.0.0.1:9093/metrics,opt/x/authdb.log",
+		"cloak-outline-ss2,http://127.0.0.1:9093/metrics,opt/x/authdb.log", // cloak label of outline-ss2
+		"outline-ss3,127.0.0.1:9093,opt/x/authdb.log",
+		"outline-ss3,http://127.0.0.1:9093/metrics",
+	} {
+		if err := list.Set(s); err == nil {
+			t.Errorf("%q: expected error", s)
+		}
+	}
+
+	metrics, err := outlineTestDataFS.ReadFile("test_data/outputs/outline-metrics.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", string(expfmt.FmtText))
+		w.Write(metrics)
+	}))
+	defer srv.Close()
+
+	rootFS, err := fs.Sub(outlineTestDataFS, "test_data")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o := &appOptions{
+		rootFS: rootFS,
+		wgi:    outlineTestWgi,
+		stats: &stat{Data: data{
+			Traffic:         make(peer[traffic]),
+			LastSeen:        make(peer[lastSeen]),
+			Endpoints:       make(peer[endpoints]),
+			Upstream:        make(peer[traffic]),
+			Activity:        make(peer[activity]),
+			Diagnostics:     make(diagnostics),
+			Unauthenticated: make(map[string]unauthenticated),
+			Geo:             make(map[string]geo),
+		}},
+	}
+
+	inst := outlineInstance{
+		proto:      "outline-ss2",
+		metricsURL: srv.URL,
+		authdb:     fmt.Sprintf("opt/outline-ss-%s/authdb.log", outlineTestWgi),
+	}
+
+	if err := handleOutlineInstance(o, inst, cloakSources{}, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	const key = "nmOqrxuL+jZPtcmDN5T2uOioAfgCVTgCxiD32k2YWag="
+
+	if _, ok := o.stats.Data.Traffic[key][protoOutline]; ok {
+		t.Error("instance traffic is reported as outline-ss")
+	}
+
+	if tr := o.stats.Data.Traffic[key][inst.proto]; tr.Sent != "4642313" {
+		t.Errorf("unexpected instance traffic: %+v", tr)
+	}
+
+	if ts := o.stats.Data.LastSeen[key][inst.proto].Timestamp; ts != "1720199389" {
+		t.Errorf("unexpected instance last seen: %q", ts)
+	}
+
+	if _, ok := o.stats.Data.LastSeen[key][protoOutlineOverCloak]; ok {
+		t.Error("instance cloak login is reported as cloak-ss")
+	}
+
+	if ts := o.stats.Data.LastSeen[key]["cloak-outline-ss2"].Timestamp; ts != "1720204440" {
+		t.Errorf("unexpected instance cloak last seen: %q", ts)
+	}
+
+	if _, ok := o.stats.Data.Unauthenticated[inst.proto]; !ok {
+		t.Error("instance unauthenticated load is not reported")
+	}
+}
+
+func TestOutlineCloakSourcesBad(t *testing.T) {
+	sources, bad := outlineCloakSources("192.168.100.120, bogus", []string{"10.0.0.1", "no-such-if0"})
+
+	if len(bad) != 2 {
+		t.Errorf("expected 2 bad sources, got %v", bad)
+	}
+
+	for _, a := range []string{"192.168.100.120", "10.0.0.1", "127.0.0.1"} {
+		if !sources.has(netip.MustParseAddr(a)) {
+			t.Errorf("%s: is not a cloak source", a)
+		}
+	}
+}
+
+func TestHandleOutlineEnvError(t *testing.T) {
+	o := &appOptions{
+		rootFS: fstest.MapFS{},
+		wgi:    outlineTestWgi,
+		stats:  &stat{Data: data{Diagnostics: make(diagnostics)}},
+	}
+
+	o.env, o.envErr = getWgQuickEnv(o.rootFS, o.wgi)
+
+	if err := handleOutline(o, nil, nil); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected the env error, got %v", err)
+	}
+}
@@ -10,28 +10,33 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	statsService "github.com/xtls/xray-core/app/stats/command"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
 )
 
-func getProto0LastSeenAndEndpoints(myFS fs.FS, wgi string) (peer[lastSeen], peer[endpoints], error) {
-	file, err := myFS.Open(fmt.Sprintf("opt/xray-%s/authdb.log", wgi))
-	if err != nil {
-		return nil, nil, fmt.Errorf("open authdb: %w", err)
-	}
+// getProto0LastSeenAndEndpoints - read new authdb lines into the tail state,
+// rotated authdb copies are read if maxAge is set.
+func getProto0LastSeenAndEndpoints(myFS fs.FS, wgi string, maxAge time.Duration, st *authdbTail) error {
+	path := fmt.Sprintf("opt/xray-%s/authdb.log", wgi)
 
-	defer file.Close()
+	if maxAge > 0 {
+		if err := readRotatedAuthDB(myFS, path, maxAge, st, parseProto0AuthDBLastSeenAndEndpoints); err != nil {
+			return fmt.Errorf("authdb: %w", err)
+		}
+	}
 
-	ls, ep, err := parseProto0AuthDBLastSeenAndEndpoints(file)
-	if err != nil {
-		return nil, nil, fmt.Errorf("parse proto0 last seen and endpoints: %w", err)
+	if err := tailAuthDB(myFS, path, st, parseProto0AuthDBLastSeenAndEndpoints); err != nil {
+		return fmt.Errorf("authdb: %w", err)
 	}
 
-	return ls, ep, nil
+	return nil
 }
 
+// getProto0Traffic - xray user stats are uplink and downlink only,
+// there is no network dimension for a transport breakdown.
 func getProto0Traffic() (peer[traffic], error) {
 	cmdConn, err := grpc.NewClient("127.0.0.1:10444", grpc.WithTransportCredentials(insecure.NewCredentials()))
 	if err != nil {
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rotatedLog - rotated copy of the log.
+type rotatedLog struct {
+	path    string
+	modTime time.Time
+	size    int64
+}
+
+// key - the rotated copy is not changed while the key is the same.
+func (r rotatedLog) key() string {
+	return strconv.FormatInt(r.size, 10) + "-" + strconv.FormatInt(r.modTime.Unix(), 10)
+}
+
+// rotatedSiblings - rotated copies of the log (authdb.log.1, authdb.log.2.gz,
+// authdb.log-20240705.gz) modified within maxAge, the oldest first.
+func rotatedSiblings(myFS fs.FS, logPath string, maxAge time.Duration, now time.Time) ([]rotatedLog, error) {
+	dir, base := path.Split(logPath)
+	dir = strings.TrimSuffix(dir, "/")
+	if dir == "" {
+		dir = "."
+	}
+
+	entries, err := fs.ReadDir(myFS, dir)
+	if err != nil {
+		return nil, fmt.Errorf("read dir: %w", err)
+	}
+
+	var list []rotatedLog
+
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !(strings.HasPrefix(name, base+".") || strings.HasPrefix(name, base+"-")) {
+			continue
+		}
+
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+
+		if now.Sub(fi.ModTime()) > maxAge {
+			continue
+		}
+
+		list = append(list, rotatedLog{path: path.Join(dir, name), modTime: fi.ModTime(), size: fi.Size()})
+	}
+
+	slices.SortFunc(list, func(a, b rotatedLog) int {
+		return a.modTime.Compare(b.modTime)
+	})
+
+	return list, nil
+}
+
+// openLog - open the log, gzip ones are decompressed.
+func openLog(myFS fs.FS, logPath string) (io.ReadCloser, error) {
+	file, err := myFS.Open(logPath)
+	if err != nil {
+		return nil, fmt.Errorf("open: %w", err)
+	}
+
+	if !strings.HasSuffix(logPath, ".gz") {
+		return file, nil
+	}
+
+	zr, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+
+		return nil, fmt.Errorf("gzip: %w", err)
+	}
+
+	return &gzipLog{Reader: zr, file: file}, nil
+}
+
+// gzipLog - closes both the gzip reader and the file.
+type gzipLog struct {
+	*gzip.Reader
+	file fs.File
+}
+
+func (g *gzipLog) Close() error {
+	g.Reader.Close()
+
+	return g.file.Close()
+}
+
+// newerTimestamp - timestamp a is newer than b,
+// unix times are compared as numbers.
+func newerTimestamp(a, b string) bool {
+	x, errA := strconv.ParseInt(a, 10, 64)
+	y, errB := strconv.ParseInt(b, 10, 64)
+
+	if errA == nil && errB == nil {
+		return x > y
+	}
+
+	return a > b
+}
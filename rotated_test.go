@@ -0,0 +1,134 @@
+package main
+
+import (
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReadRotatedAuthDB(t *testing.T) {
+	dir := t.TempDir()
+	rootFS := os.DirFS(dir)
+
+	const (
+		keyA = "nmOqrxuL+jZPtcmDN5T2uOioAfgCVTgCxiD32k2YWag="
+		keyB = "lNDBjtWn1ysCQcDc1ifRQDVfzM8fx0Y2+dsd6QtN4Hs="
+		keyC = "e45JqFuA4yC78J9owAozUW9FVzxOWVxTNjU4fNp2auU="
+	)
+
+	now := time.Now()
+
+	write := func(name, data string, age time.Duration) {
+		t.Helper()
+
+		path := filepath.Join(dir, name)
+
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if filepath.Ext(name) == ".gz" {
+			zw := gzip.NewWriter(f)
+			if _, err := zw.Write([]byte(data)); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := zw.Close(); err != nil {
+				t.Fatal(err)
+			}
+		} else if _, err := f.WriteString(data); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.Chtimes(path, now.Add(-age), now.Add(-age)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("authdb.log", "nmOqrxuL-jZPtcmDN5T2uOioAfgCVTgCxiD32k2YWag= 2024-07-05T19:00:00.000Z 10.0.0.1 1720206000\n", 0)
+	// the newest entry of keyA is in the current log.
+	write("authdb.log.1", "lNDBjtWn1ysCQcDc1ifRQDVfzM8fx0Y2-dsd6QtN4Hs= 2024-07-04T18:00:00.000Z 10.0.1.1 1720116000\n"+
+		"nmOqrxuL-jZPtcmDN5T2uOioAfgCVTgCxiD32k2YWag= 2024-07-04T19:00:00.000Z 10.0.2.1 1720119600\n", time.Hour)
+	write("authdb.log.2.gz", "nmOqrxuL-jZPtcmDN5T2uOioAfgCVTgCxiD32k2YWag= 2024-07-03T19:00:00.000Z 10.0.3.1 1720033200\n", 2*time.Hour)
+	// too old.
+	write("authdb.log.3.gz", "e45JqFuA4yC78J9owAozUW9FVzxOWVxTNjU4fNp2auU= 2024-07-01T19:00:00.000Z 10.0.4.1 1719860400\n", 48*time.Hour)
+
+	var st authdbTail
+
+	if err := tailAuthDB(rootFS, "authdb.log", &st, parseProto0AuthDBLastSeenAndEndpoints); err != nil {
+		t.Fatal(err)
+	}
+
+	// rotated copies are older, they don't override the current log.
+	if err := readRotatedAuthDB(rootFS, "authdb.log", 24*time.Hour, &st, parseProto0AuthDBLastSeenAndEndpoints); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		key, ts, subnet string
+	}{
+		{keyA, "1720206000", "10.0.0.0/24"},
+		{keyB, "1720116000", "10.0.1.0/24"},
+	}
+
+	for _, tc := range testCases {
+		if ts := st.LastSeen[tc.key][protoProto0].Timestamp; ts != tc.ts {
+			t.Errorf("%s: unexpected last seen %q", tc.key, ts)
+		}
+
+		if subnet := st.Endpoints[tc.key][protoProto0].Subnet; subnet != tc.subnet {
+			t.Errorf("%s: unexpected endpoint %q", tc.key, subnet)
+		}
+	}
+
+	if _, ok := st.LastSeen[keyC]; ok {
+		t.Error("too old rotated log is read")
+	}
+
+	if len(st.Rotated) != 2 {
+		t.Errorf("unexpected rotated logs: %v", st.Rotated)
+	}
+}
+
+func TestReadRotatedAuthDBUnreadable(t *testing.T) {
+	dir := t.TempDir()
+	rootFS := os.DirFS(dir)
+
+	const key = "nmOqrxuL+jZPtcmDN5T2uOioAfgCVTgCxiD32k2YWag="
+
+	for name, data := range map[string]string{
+		"authdb.log":   "",
+		"authdb.log.1": "nmOqrxuL-jZPtcmDN5T2uOioAfgCVTgCxiD32k2YWag= 2024-07-04T19:00:00.000Z 10.0.2.1 1720119600\n",
+		// compression is in progress.
+		"authdb.log.2.gz": "\x1f\x8b\x08",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var st authdbTail
+
+	if err := readRotatedAuthDB(rootFS, "authdb.log", 24*time.Hour, &st, parseProto0AuthDBLastSeenAndEndpoints); err != nil {
+		t.Fatal(err)
+	}
+
+	if ts := st.LastSeen[key][protoProto0].Timestamp; ts != "1720119600" {
+		t.Errorf("readable copy is not read: %q", ts)
+	}
+
+	if len(st.failed) != 1 || st.failed[0] != "authdb.log.2.gz" {
+		t.Errorf("unexpected failed copies: %v", st.failed)
+	}
+
+	if _, ok := st.Rotated["authdb.log.2.gz"]; ok {
+		t.Error("unreadable copy is marked as read")
+	}
+}
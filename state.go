@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// stateFileName - state file name for the source path,
+// e.g. "ccd", "opt/openvpn-wg0/ccd" -> "ccd-opt_openvpn-wg0_ccd.json".
+func stateFileName(kind, path string) string {
+	return kind + "-" + strings.ReplaceAll(strings.Trim(path, "/"), "/", "_") + ".json"
+}
+
+// loadState - load json state from the state dir,
+// missing state is not an error, v stays untouched.
+func loadState(dir, name string, v any) error {
+	if dir == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+
+		return fmt.Errorf("read state: %w", err)
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("unmarshal state: %w", err)
+	}
+
+	return nil
+}
+
+// saveState - save json state to the state dir atomically.
+func saveState(dir, name string, v any) error {
+	if dir == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("marshal state: %w", err)
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("create state dir: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(dir, name+".*")
+	if err != nil {
+		return fmt.Errorf("create temp state: %w", err)
+	}
+
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+
+		return fmt.Errorf("write temp state: %w", err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close temp state: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, name)); err != nil {
+		return fmt.Errorf("rename state: %w", err)
+	}
+
+	return nil
+}
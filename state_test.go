@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestStateRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	name := stateFileName("ccd", "opt/openvpn-wg7/ccd")
+
+	if name != "ccd-opt_openvpn-wg7_ccd.json" {
+		t.Errorf("unexpected state file name: %q", name)
+	}
+
+	cache := make(ccdCache)
+	if err := loadState(dir, name, &cache); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cache) != 0 {
+		t.Fatalf("expected empty state, got %v", cache)
+	}
+
+	cache["cn"] = ccdCacheEntry{ModTime: 1, Size: 2, Key: "key", UID: "uid"}
+	if err := saveState(dir, name, cache); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := make(ccdCache)
+	if err := loadState(dir, name, &loaded); err != nil {
+		t.Fatal(err)
+	}
+
+	if loaded["cn"] != cache["cn"] {
+		t.Errorf("expected %+v, got %+v", cache["cn"], loaded["cn"])
+	}
+}
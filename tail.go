@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"time"
+)
+
+// authdbTail - read position of the authdb log and the peer data read so far,
+// kept between runs, so each run reads new lines only.
+type authdbTail struct {
+	Dev    uint64 `json:"dev,omitempty"`
+	Ino    uint64 `json:"ino,omitempty"`
+	Offset int64  `json:"offset"`
+	// Head is a checksum of the file head, which is changed
+	// by truncation and rewrite (copytruncate).
+	Head uint32 `json:"head,omitempty"`
+	// Rotated - rotated copies read already, path -> key.
+	Rotated map[string]string `json:"rotated,omitempty"`
+
+	LastSeen  peer[lastSeen]  `json:"last-seen"`
+	Endpoints peer[endpoints] `json:"endpoints"`
+
+	// failed - rotated copies which can't be read in this run.
+	failed []string
+}
+
+// authdbHeadSize - size of the file head to detect truncation.
+const authdbHeadSize = 256
+
+// authdbParser - parse authdb lines.
+type authdbParser func(io.Reader) (peer[lastSeen], peer[endpoints], error)
+
+// tailAuthDB - parse complete lines of the file added since the state offset
+// and merge them into the state. The file is read from the start if it is
+// replaced (rotated) or truncated, the known peer data is kept.
+func tailAuthDB(myFS fs.FS, path string, st *authdbTail, parse authdbParser) error {
+	file, err := myFS.Open(path)
+	if err != nil {
+		return fmt.Errorf("open: %w", err)
+	}
+
+	defer file.Close()
+
+	fi, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("stat: %w", err)
+	}
+
+	dev, ino, ok := fileID(fi)
+	if (ok && (dev != st.Dev || ino != st.Ino)) || fi.Size() < st.Offset {
+		st.Offset = 0
+	}
+
+	if st.Offset > 0 {
+		head, err := fileHead(myFS, path, min(st.Offset, authdbHeadSize))
+		if err != nil {
+			return fmt.Errorf("head: %w", err)
+		}
+
+		if head != st.Head {
+			st.Offset = 0
+		}
+	}
+
+	st.Dev, st.Ino = dev, ino
+
+	if err := skipTo(file, st.Offset); err != nil {
+		return fmt.Errorf("seek: %w", err)
+	}
+
+	// the size is fixed, lines are appended while reading.
+	r := &completeLinesReader{br: bufio.NewReader(io.LimitReader(file, fi.Size()-st.Offset))}
+
+	ls, ep, err := parse(r)
+	if err != nil {
+		return fmt.Errorf("parse: %w", err)
+	}
+
+	st.mergeNewest(ls, ep)
+
+	st.Offset += r.n
+
+	st.Head, err = fileHead(myFS, path, min(st.Offset, authdbHeadSize))
+	if err != nil {
+		return fmt.Errorf("head: %w", err)
+	}
+
+	return nil
+}
+
+// fileHead - checksum of the first n bytes of the file.
+func fileHead(myFS fs.FS, path string, n int64) (uint32, error) {
+	file, err := myFS.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("open: %w", err)
+	}
+
+	defer file.Close()
+
+	h := crc32.NewIEEE()
+	if _, err := io.CopyN(h, file, n); err != nil {
+		return 0, fmt.Errorf("read: %w", err)
+	}
+
+	return h.Sum32(), nil
+}
+
+// readRotatedAuthDB - parse rotated copies of the authdb modified within maxAge,
+// which are not read yet, into the state. Unreadable copies are skipped,
+// retried next run and listed in the failed ones.
+func readRotatedAuthDB(myFS fs.FS, path string, maxAge time.Duration, st *authdbTail, parse authdbParser) error {
+	list, err := rotatedSiblings(myFS, path, maxAge, time.Now())
+	if err != nil {
+		return fmt.Errorf("rotated: %w", err)
+	}
+
+	rotated := make(map[string]string, len(list))
+
+	for _, r := range list {
+		if st.Rotated[r.path] == r.key() {
+			rotated[r.path] = r.key()
+
+			continue
+		}
+
+		ls, ep, err := parseLog(myFS, r.path, parse)
+		if err != nil {
+			debugLog("authdb rotated:", r.path, err)
+			st.failed = append(st.failed, r.path)
+
+			continue
+		}
+
+		rotated[r.path] = r.key()
+		st.mergeNewest(ls, ep)
+	}
+
+	st.Rotated = rotated
+
+	return nil
+}
+
+// parseLog - parse the whole log, gzip ones are decompressed.
+func parseLog(myFS fs.FS, path string, parse authdbParser) (peer[lastSeen], peer[endpoints], error) {
+	r, err := openLog(myFS, path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer r.Close()
+
+	return parse(r)
+}
+
+// mergeNewest - merge peer data, the newer last seen wins with its endpoint.
+func (st *authdbTail) mergeNewest(ls peer[lastSeen], ep peer[endpoints]) {
+	if st.LastSeen == nil {
+		st.LastSeen = make(peer[lastSeen])
+	}
+
+	if st.Endpoints == nil {
+		st.Endpoints = make(peer[endpoints])
+	}
+
+	older := make(map[string]map[string]bool)
+
+	for key, protos := range ls {
+		for protoName, l := range protos {
+			if cur, ok := st.LastSeen[key][protoName]; ok && newerTimestamp(cur.Timestamp, l.Timestamp) {
+				if older[key] == nil {
+					older[key] = make(map[string]bool)
+				}
+
+				older[key][protoName] = true
+
+				continue
+			}
+
+			if st.LastSeen[key] == nil {
+				st.LastSeen[key] = make(map[string]lastSeen)
+			}
+
+			st.LastSeen[key][protoName] = l
+		}
+	}
+
+	for key, protos := range ep {
+		for protoName, e := range protos {
+			if older[key][protoName] {
+				continue
+			}
+
+			if st.Endpoints[key] == nil {
+				st.Endpoints[key] = make(map[string]endpoints)
+			}
+
+			st.Endpoints[key][protoName] = e
+		}
+	}
+}
+
+// skipTo - move the file position to the offset.
+func skipTo(file fs.File, offset int64) error {
+	if offset == 0 {
+		return nil
+	}
+
+	if s, ok := file.(io.Seeker); ok {
+		_, err := s.Seek(offset, io.SeekStart)
+
+		return err
+	}
+
+	_, err := io.CopyN(io.Discard, file, offset)
+
+	return err
+}
+
+// completeLinesReader - reader of complete lines only, a partial last line
+// is left for the next run. n is a count of bytes read.
+type completeLinesReader struct {
+	br      *bufio.Reader
+	pending []byte
+	n       int64
+}
+
+func (c *completeLinesReader) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		line, err := c.br.ReadBytes('\n')
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return 0, io.EOF
+			}
+
+			return 0, err
+		}
+
+		c.pending = line
+		c.n += int64(len(line))
+	}
+
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+
+	return n, nil
+}
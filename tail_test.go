@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTailAuthDB(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "authdb.log")
+	rootFS := os.DirFS(dir)
+
+	const (
+		keyA = "nmOqrxuL+jZPtcmDN5T2uOioAfgCVTgCxiD32k2YWag="
+		keyB = "lNDBjtWn1ysCQcDc1ifRQDVfzM8fx0Y2+dsd6QtN4Hs="
+	)
+
+	write := func(flag int, data string) {
+		t.Helper()
+
+		f, err := os.OpenFile(path, flag|os.O_WRONLY|os.O_CREATE, 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := f.WriteString(data); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var st authdbTail
+
+	tail := func(wantOffset int64) {
+		t.Helper()
+
+		if err := tailAuthDB(rootFS, "authdb.log", &st, parseProto0AuthDBLastSeenAndEndpoints); err != nil {
+			t.Fatal(err)
+		}
+
+		if st.Offset != wantOffset {
+			t.Errorf("expected offset %d, got %d", wantOffset, st.Offset)
+		}
+	}
+
+	lineA := "nmOqrxuL-jZPtcmDN5T2uOioAfgCVTgCxiD32k2YWag= 2024-07-05T17:09:49.470Z 176.59.111.157 1720199389\n"
+	lineA2 := "nmOqrxuL-jZPtcmDN5T2uOioAfgCVTgCxiD32k2YWag= 2024-07-05T19:09:49.470Z 10.1.2.3 1720206589\n"
+	lineB := "lNDBjtWn1ysCQcDc1ifRQDVfzM8fx0Y2-dsd6QtN4Hs= 2024-07-05T18:23:06.354Z 176.59.3.211 1720203786\n"
+
+	// a partial line is left for the next run.
+	write(os.O_TRUNC, lineA+lineB[:10])
+	tail(int64(len(lineA)))
+
+	if _, ok := st.LastSeen[keyB]; ok {
+		t.Error("partial line is parsed")
+	}
+
+	write(os.O_APPEND, lineB[10:])
+	tail(int64(len(lineA + lineB)))
+
+	if ts := st.LastSeen[keyB][protoProto0].Timestamp; ts != "1720203786" {
+		t.Errorf("unexpected last seen: %q", ts)
+	}
+
+	// rotation, the known peers are kept.
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+
+	write(os.O_TRUNC, lineA2)
+	tail(int64(len(lineA2)))
+
+	if ts := st.LastSeen[keyA][protoProto0].Timestamp; ts != "1720206589" {
+		t.Errorf("unexpected last seen after rotation: %q", ts)
+	}
+
+	if subnet := st.Endpoints[keyA][protoProto0].Subnet; subnet != "10.1.2.0/24" {
+		t.Errorf("unexpected endpoint after rotation: %q", subnet)
+	}
+
+	if _, ok := st.LastSeen[keyB]; !ok {
+		t.Error("known peer is lost after rotation")
+	}
+
+	// truncation in place.
+	write(os.O_TRUNC, lineB)
+	tail(int64(len(lineB)))
+}
@@ -4,6 +4,15 @@ type (
 	traffic struct {
 		Received string `json:"received"`
 		Sent     string `json:"sent"`
+		// Transport is a breakdown by transport (tcp, udp),
+		// filled only if the collector can tell it.
+		Transport map[string]transfer `json:"transport,omitempty"`
+	}
+
+	// transfer - byte counters of the one transport.
+	transfer struct {
+		Received string `json:"received"`
+		Sent     string `json:"sent"`
 	}
 
 	lastSeen struct {
@@ -12,21 +21,57 @@ type (
 
 	endpoints struct {
 		Subnet string `json:"subnet"`
+		// Recent is a list of recent distinct subnets, the newest first.
+		Recent []string `json:"recent,omitempty"`
+	}
+
+	// limits - configured peer limits, rates are in kbit/s.
+	// accel-ppp limits are reported under ipsec, the chap-secrets owner,
+	// and under every accel-ppp protocol the peer has a session on.
+	limits struct {
+		Down string `json:"down,omitempty"`
+		Up   string `json:"up,omitempty"`
+		Pool string `json:"pool,omitempty"`
+	}
+
+	// session - single session of the peer.
+	session struct {
+		Subnet         string `json:"subnet,omitempty"`
+		Received       string `json:"received"`
+		Sent           string `json:"sent"`
+		ConnectedSince string `json:"connected-since,omitempty"`
+	}
+
+	// sessions - concurrent sessions of the peer,
+	// the list is filled for diagnostic only.
+	sessions struct {
+		Count          string    `json:"count"`
+		ConnectedSince string    `json:"connected-since,omitempty"`
+		List           []session `json:"list,omitempty"`
+	}
+
+	// activity - usage other than bytes, where the collector reports it.
+	activity struct {
+		// ConnectedSeconds is a time at least one connection was open.
+		ConnectedSeconds string `json:"connected-seconds,omitempty"`
+		// ClosedConnections is a count of closed connections of any outcome,
+		// opened ones are not reported per peer.
+		ClosedConnections string `json:"closed-connections,omitempty"`
 	}
 
 	metrics interface {
-		traffic | lastSeen | endpoints
+		traffic | lastSeen | endpoints | limits | sessions | activity
 	}
 
 	// <protoname>: {
-	// 	<traffic | lastSeen | endpoints>: <value>
+	// 	<traffic | lastSeen | endpoints | limits | sessions | activity>: <value>
 	// }
 	proto[T metrics] map[string]T
 
 	// {
 	// 	<username>: {
 	// 		<protoname>: {
-	// 			<traffic | lastSeen | endpoints>: <value>
+	// 			<traffic | lastSeen | endpoints | limits | sessions | activity>: <value>
 	// 		}
 	// 	}
 	// }
@@ -37,16 +82,80 @@ type (
 	// if aggregated flag is 1, the protocol traffic is aggregated.
 	aggregated map[string]int
 
+	// diagnostic - collector problems which don't fail the whole protocol.
+	diagnostic struct {
+		// Skipped is a count of lines which can't be parsed.
+		Skipped int `json:"skipped,omitempty"`
+		// Unmapped is a list of entries without wg public key mapping.
+		Unmapped []string `json:"unmapped,omitempty"`
+		// Errors is a list of sources which can't be read or parsed.
+		Errors []string `json:"errors,omitempty"`
+		// Inexact is a count of samples which can't be represented exactly.
+		Inexact int `json:"inexact,omitempty"`
+		// StaleSince is a unix time of the last update of the stale data source.
+		StaleSince string `json:"stale-since,omitempty"`
+	}
+
+	// diagnostics[<protoname>] is a protocol diagnostic.
+	diagnostics map[string]diagnostic
+
+	// unauthenticated - server level load of connections
+	// without a valid access key, probing and scanning.
+	unauthenticated struct {
+		traffic
+		Connections string `json:"connections,omitempty"`
+	}
+
+	// geo - traffic by client location (country code) and asn,
+	// the empty ones are unknown.
+	geo struct {
+		Location map[string]traffic `json:"location,omitempty"`
+		ASN      map[string]traffic `json:"asn,omitempty"`
+	}
+
+	// unattributed[<protoname>][<username | common name>] is a traffic
+	// of sessions without wg public key mapping.
+	unattributed map[string]map[string]traffic
+
 	data struct {
 		Aggregated aggregated      `json:"aggregated"`
 		Traffic    peer[traffic]   `json:"traffic"`
 		LastSeen   peer[lastSeen]  `json:"last-seen"`
 		Endpoints  peer[endpoints] `json:"endpoints"`
+		Limits     peer[limits]    `json:"limits,omitempty"`
+		Sessions   peer[sessions]  `json:"sessions,omitempty"`
+		// Upstream is a proxy to target traffic, where the proxy reports it.
+		Upstream peer[traffic] `json:"upstream,omitempty"`
+		// Fronted is a traffic counted by a fronting transport (cloak) since
+		// the state is kept. It overlaps with the traffic of the fronted
+		// protocols (cloak-openvpn, cloak-ss) and is a cross-check, not an addition.
+		Fronted peer[traffic] `json:"fronted,omitempty"`
+		// Activity is a usage other than bytes, where the collector reports it.
+		Activity     peer[activity] `json:"activity,omitempty"`
+		Diagnostics  diagnostics    `json:"diagnostics,omitempty"`
+		Unattributed unattributed   `json:"unattributed,omitempty"`
+		// Unauthenticated[<protoname>] is a server level load without a valid key.
+		Unauthenticated map[string]unauthenticated `json:"unauthenticated,omitempty"`
+		// Geo[<protoname>] is a server level traffic by client location.
+		Geo map[string]geo `json:"geo,omitempty"`
+	}
+
+	// endpointInfo - where and by what the report was collected.
+	endpointInfo struct {
+		Interface string `json:"interface"`
+		ExtDev    string `json:"ext-dev,omitempty"`
+		ExtIP     string `json:"ext-ip,omitempty"`
+		ExtCIDR   string `json:"ext-cidr,omitempty"`
+		Hostname  string `json:"hostname,omitempty"`
+		Version   string `json:"version,omitempty"`
+		// Duration is the collection time in milliseconds.
+		Duration string `json:"duration-ms"`
 	}
 
 	stat struct {
-		Code      string `json:"code"`
-		Data      data   `json:"data"`
-		Timestamp string `json:"timestamp"`
+		Code      string       `json:"code"`
+		Endpoint  endpointInfo `json:"endpoint"`
+		Data      data         `json:"data"`
+		Timestamp string       `json:"timestamp"`
 	}
 )
@@ -6,6 +6,8 @@ import (
 	"io"
 	"net/netip"
 	"os/exec"
+	"strconv"
+	"strings"
 )
 
 const (
@@ -43,6 +45,123 @@ func mergePeers[T metrics](peersA, peersB peer[T]) peer[T] {
 	return peersA
 }
 
+// relabelPeers - move peer data of the protocol to the other label.
+func relabelPeers[T metrics](peers peer[T], from, to string) peer[T] {
+	if from == to {
+		return peers
+	}
+
+	for _, protos := range peers {
+		if v, ok := protos[from]; ok {
+			delete(protos, from)
+			protos[to] = v
+		}
+	}
+
+	return peers
+}
+
+// add - merge protocol diagnostic, empty ones are not stored.
+func (d diagnostics) add(protoName string, diag diagnostic) {
+	existing := d[protoName]
+
+	existing.Skipped += diag.Skipped
+	existing.Inexact += diag.Inexact
+	existing.Unmapped = append(existing.Unmapped, diag.Unmapped...)
+	existing.Errors = append(existing.Errors, diag.Errors...)
+
+	if diag.StaleSince != "" {
+		existing.StaleSince = diag.StaleSince
+	}
+
+	if existing.Skipped == 0 && existing.Inexact == 0 && len(existing.Unmapped) == 0 && len(existing.Errors) == 0 && existing.StaleSince == "" {
+		return
+	}
+
+	d[protoName] = existing
+}
+
+// add - add session traffic, sessions with the same id are summed.
+func (u unattributed) add(protoName, id string, t traffic) {
+	if id == "" {
+		id = unattributedUnknown
+	}
+
+	if _, ok := u[protoName]; !ok {
+		u[protoName] = make(map[string]traffic)
+	}
+
+	u[protoName][id] = sumTraffic(u[protoName][id], t)
+}
+
+// merge - merge unattributed traffic from other collector.
+func (u unattributed) merge(other unattributed) {
+	for protoName, ids := range other {
+		for id, t := range ids {
+			u.add(protoName, id, t)
+		}
+	}
+}
+
+// sumTraffic - sum string byte counters, invalid counters are treated as zero.
+// Transport breakdowns are summed too.
+func sumTraffic(a, b traffic) traffic {
+	sum := traffic{
+		Received: strconv.FormatUint(parseCounter(a.Received)+parseCounter(b.Received), 10),
+		Sent:     strconv.FormatUint(parseCounter(a.Sent)+parseCounter(b.Sent), 10),
+	}
+
+	for _, t := range []map[string]transfer{a.Transport, b.Transport} {
+		for name, x := range t {
+			sum.addTransport(name, parseCounter(x.Received), parseCounter(x.Sent))
+		}
+	}
+
+	return sum
+}
+
+// addTransport - add byte counters to the transport breakdown,
+// the totals are not changed.
+func (t *traffic) addTransport(name string, received, sent uint64) {
+	if t.Transport == nil {
+		t.Transport = make(map[string]transfer)
+	}
+
+	x := t.Transport[name]
+	t.Transport[name] = transfer{
+		Received: strconv.FormatUint(parseCounter(x.Received)+received, 10),
+		Sent:     strconv.FormatUint(parseCounter(x.Sent)+sent, 10),
+	}
+}
+
+func parseCounter(s string) uint64 {
+	if s == "" {
+		return 0
+	}
+
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		debugLog("parse counter:", err)
+
+		return 0
+	}
+
+	return n
+}
+
+// splitList - split comma separated list, empty items are dropped.
+func splitList(s string) []string {
+	var list []string
+
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
+
 // ipToSubnet - cut the ip to common subnet.
 func ipToSubnet(s string) (string, error) {
 	ip, err := netip.ParseAddr(s)
@@ -1,10 +1,8 @@
 package main
 
 import (
-	"bufio"
 	"fmt"
 	"io/fs"
-	"strings"
 
 	"golang.zx2c4.com/wireguard/wgctrl"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
@@ -79,44 +77,19 @@ func getWgEndpoints(p []wgtypes.Peer) peer[endpoints] {
 	return peers
 }
 
-func getOutlineSSPortAndPublicIP(myFS fs.FS, filePath string) (string, string, error) {
-	file, err := myFS.Open(filePath)
+// getWgQuickEnv - env of the wg-quick namespace of the interface.
+func getWgQuickEnv(myFS fs.FS, wgi string) (map[string]string, error) {
+	file, err := myFS.Open("etc/wg-quick-ns.env." + wgi)
 	if err != nil {
-		return "", "", fmt.Errorf("failed to open file: %w", err)
+		return nil, fmt.Errorf("open: %w", err)
 	}
 
 	defer file.Close()
 
-	var (
-		addr string
-		port string
-	)
-
-	scanner := bufio.NewScanner(file)
-
-	for scanner.Scan() {
-		line := scanner.Text()
-		switch {
-		case strings.HasPrefix(line, "OUTLINE_SS_PORT="):
-			parts := strings.SplitN(line, "=", 2)
-			if len(parts) == 2 {
-				port = parts[1]
-			}
-		case strings.HasPrefix(line, "EXT_IP="):
-			parts := strings.SplitN(line, "=", 2)
-			if len(parts) == 2 {
-				addr = parts[1]
-			}
-		}
-
-		if port != "" && addr != "" {
-			return port, addr, nil
-		}
-	}
-
-	if err = scanner.Err(); err != nil {
-		return "", "", fmt.Errorf("scanner error: %w", err)
+	env, err := parseEnvFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("parse: %w", err)
 	}
 
-	return "", "", fmt.Errorf("OUTLINE_SS_PORT not found in file")
+	return env, nil
 }